@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/bluet/syspkg"
@@ -12,21 +13,30 @@ import (
 )
 
 type PackageInfo struct {
-	Name       string `json:"name"`
-	Version    string `json:"version"`
-	NewVersion string `json:"new_version,omitempty"`
-	Category   string `json:"category,omitempty"`
-	Arch       string `json:"arch,omitempty"`
+	Name       string          `json:"name"`
+	Version    string          `json:"version"`
+	NewVersion string          `json:"new_version,omitempty"`
+	Category   string          `json:"category,omitempty"`
+	Arch       string          `json:"arch,omitempty"`
+	UpdateType string          `json:"update_type,omitempty"` // "major", "minor" or "patch"
+	CVEs       []CVE           `json:"cves,omitempty"`
+	Severity   string          `json:"severity,omitempty"` // highest severity of CVEs
+	Details    *PackageDetails `json:"details,omitempty"`
 }
 
 // TelemetryData contains the collected telemetry information
 type TelemetryData struct {
-	CPUUsage      float64     `json:"cpu_usage"`
-	MemoryUsage   float64     `json:"memory_usage"`
-	OSInfo        string      `json:"os_info"`
-	CurrentUser   string      `json:"current_user"`
-	LoggedInUsers []string    `json:"logged_in_user"`
-	DiskUsage     []DiskUsage `json:"disk_usage"`
+	Timestamp     time.Time     `json:"timestamp"`
+	CPUUsage      float64       `json:"cpu_usage"`
+	MemoryUsage   float64       `json:"memory_usage"`
+	OSInfo        string        `json:"os_info"`
+	CurrentUser   string        `json:"current_user"`
+	LoggedInUsers []string      `json:"logged_in_user"`
+	DiskUsage     []DiskUsage   `json:"disk_usage"`
+	ConfigVersion string        `json:"config_version,omitempty"`
+	RolloutGroup  string        `json:"rollout_group,omitempty"`
+	Reboot        RebootStatus  `json:"reboot"`
+	PackageDrift  *PackageDrift `json:"package_drift,omitempty"` // only with a desired state in packages
 }
 
 // struct to hold all disk usage information
@@ -38,6 +48,40 @@ type DiskUsage struct {
 	UsedPercent float64 `json:"used_percent"`
 }
 
+// UpgradeResult describes the outcome of a single upgrade run
+type UpgradeResult struct {
+	ID            string           `json:"id"`
+	InstructionID string           `json:"instruction_id,omitempty"`
+	Hostname      string           `json:"hostname"`
+	Trigger       string           `json:"trigger"`
+	Operation     string           `json:"operation,omitempty"` // install, remove or enforce; empty for upgrades
+	StartedAt     time.Time        `json:"started_at"`
+	FinishedAt    time.Time        `json:"finished_at"`
+	Success       bool             `json:"success"`
+	Error         string           `json:"error,omitempty"`
+	DryRun        bool             `json:"dry_run,omitempty"`
+	Plan          *UpgradePlan     `json:"plan,omitempty"`
+	Hooks         []HookResult     `json:"hooks,omitempty"`
+	Snapshot      *Snapshot        `json:"snapshot,omitempty"`
+	Reboot        *RebootStatus    `json:"reboot,omitempty"`
+	Services      []ServiceRestart `json:"services_needing_restart,omitempty"`
+
+	// what the run changed, recorded in state_dir/upgrades for rollback
+	PackageManager string          `json:"package_manager,omitempty"`
+	Changes        []PackageChange `json:"changes,omitempty"`
+	Transaction    string          `json:"transaction,omitempty"` // dnf/yum history transaction ID
+	RollbackOf     string          `json:"rollback_of,omitempty"` // ID of the upgrade this run reverted
+	NotReverted    []RevertFailure `json:"not_reverted,omitempty"`
+}
+
+// Upgrade triggers recorded in UpgradeResult
+const (
+	UpgradeTriggerCLI     = "cli"
+	UpgradeTriggerBackend = "backend"
+	// remediation of drift from the desired package state
+	UpgradeTriggerRemediation = "remediation"
+)
+
 type TelemetryDataProvider interface {
 	CollectTelemetryData(config *Config) (TelemetryData, error)
 }
@@ -54,6 +98,16 @@ type PackageInfoReporter interface {
 	ReportPackageInfo(config *Config, packages []PackageInfo) error
 }
 
+// RepositoryReporter is implemented by package info reporters that also
+// report the configured package sources
+type RepositoryReporter interface {
+	ReportRepositories(config *Config, repos []Repository) error
+}
+
+type UpgradeResultReporter interface {
+	ReportUpgradeResult(config *Config, result UpgradeResult) error
+}
+
 type UpgradeChecker interface {
 	CheckAndPerformUpgrade(config *Config) error
 }
@@ -69,17 +123,48 @@ func RunDaemon() {
 	if err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
-	log.Printf("Loaded configuration: %v", config)
+	log.Printf("Loaded configuration: %v", config.redacted())
 	log.Printf("Checking for telemetry in %s\n", config.PollInterval)
 	log.Printf("Checking for package updates in %s\n", config.UpgradeCheckPeriod)
 
-	lastUpgradeCheck := time.Now().Add(-config.UpgradeCheckPeriod)
+	var telemetrySender TelemetryDataSender = &DefaultTelemetryDataSender{}
+	var packageReporter PackageInfoReporter = &DefaultPackageInfoReporter{}
+	var resultReporter UpgradeResultReporter = &DefaultUpgradeResultReporter{}
+	if config.FileSink.Enabled {
+		sink, err := NewFileSink(config.FileSink)
+		if err != nil {
+			log.Fatalf("Error opening file sink: %v", err)
+		}
+		defer sink.Close()
+		log.Printf("Writing records to %s\n", config.FileSink.Path)
+		telemetrySender, packageReporter, resultReporter = sink, sink, sink
+	}
+
+	upgradeChecker := &DefaultUpgradeChecker{
+		Verifier: NewInstructionVerifier(),
+		Reporter: resultReporter,
+	}
+	if len(config.Instructions.PublicKeys) == 0 && !config.Instructions.AllowUnsigned {
+		log.Printf("No instruction public key configured, upgrade instructions will be rejected")
+	}
+
+	store, err := OpenStateStore(config.StateDir)
+	if err != nil {
+		log.Printf("Error opening agent state, state will not survive a restart: %v\n", err)
+		store = &StateStore{}
+	}
 
-	ticker := time.NewTicker(config.PollInterval)
-	for range ticker.C {
-		handleTelemetry(config, &DefaultTelemetryDataProvider{}, &DefaultTelemetryDataSender{})
-		lastUpgradeCheck = handlePackageInfo(config, &DefaultPackageInfoProvider{}, &DefaultPackageInfoReporter{}, lastUpgradeCheck, &DefaultUpgradeChecker{})
+	d := &daemon{
+		config:           config,
+		telemetrySender:  telemetrySender,
+		packageReporter:  packageReporter,
+		resultReporter:   resultReporter,
+		upgradeChecker:   upgradeChecker,
+		lastUpgradeCheck: time.Now().Add(-config.UpgradeCheckPeriod),
+		commands:         make(chan *Instruction),
+		store:            store,
 	}
+	d.run()
 }
 
 func RunShowMetrics() error {
@@ -87,7 +172,7 @@ func RunShowMetrics() error {
 	if err != nil {
 		return fmt.Errorf("Error loading configuration: %v", err)
 	}
-	log.Printf("Loaded configuration: %v", config)
+	log.Printf("Loaded configuration: %v", config.redacted())
 
 	// Print system info
 	// Create an instance of DefaultTelemetryDataProvider
@@ -141,12 +226,15 @@ func RunShowMetrics() error {
 	return nil
 }
 
-func RunSysup(autoYes bool) error {
-	// Call CheckUpgradablePackages on the upgradeChecker instance
-	// config, err := LoadConfig()
-	// if err != nil {
-	// 	return fmt.Errorf("Error loading configuration: %v", err)
-	// }
+func RunSysup(autoYes bool, dryRun bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+
+	if dryRun {
+		return runSysupDryRun(config)
+	}
 
 	pms, err := syspkg.NewPackageManager()
 	if err != nil {
@@ -176,14 +264,83 @@ func RunSysup(autoYes bool) error {
 	// err = upgradePerformer.PerformUpgrade(autoYes)
 	fmt.Println("Performing package upgrade...")
 
-	for _, pm := range pms {
-		err := pm.Upgrade()
+	result := UpgradeResult{
+		ID:        utils.RandomID(),
+		Hostname:  config.Hostname,
+		Trigger:   UpgradeTriggerCLI,
+		StartedAt: time.Now(),
+	}
+	err = executeUpgrade(config, &result, func() error {
+		var upgradeErr error
+		for _, pm := range pms {
+			err := pm.Upgrade()
+			if err != nil {
+				fmt.Printf("Error performing system upgrade: %v", err)
+				if upgradeErr == nil {
+					upgradeErr = err
+				}
+			}
+		}
+		return upgradeErr
+	})
+	finishUpgradeResult(config, &result, err)
+
+	if config.FileSink.Enabled {
+		sink, err := NewFileSink(config.FileSink)
 		if err != nil {
-			fmt.Printf("Error performing system upgrade: %v", err)
+			return fmt.Errorf("Error opening file sink: %v", err)
+		}
+		defer sink.Close()
+		if err := sink.ReportUpgradeResult(config, result); err != nil {
+			return fmt.Errorf("Error recording upgrade result: %v", err)
 		}
 	}
 
+	if err != nil {
+		return err
+	}
 	fmt.Println("System upgrade completed successfully.")
+	if result.Reboot != nil && result.Reboot.Required {
+		fmt.Printf("A reboot is required: %s\n", strings.Join(result.Reboot.Reasons, "; "))
+	}
+	for _, service := range result.Services {
+		if service.Restarted {
+			fmt.Printf("Restarted %s\n", service.Unit)
+		} else {
+			fmt.Printf("%s uses replaced files and should be restarted\n", service.Unit)
+		}
+	}
+	return nil
+}
+
+// runSysupDryRun prints what an upgrade would change without changing the system
+func runSysupDryRun(config *Config) error {
+	result := UpgradeResult{
+		ID:        utils.RandomID(),
+		Hostname:  config.Hostname,
+		Trigger:   UpgradeTriggerCLI,
+		StartedAt: time.Now(),
+		DryRun:    true,
+	}
+	plan, err := planUpgrade()
+	result.Plan = plan
+	finishUpgradeResult(config, &result, err)
+	if err != nil {
+		return fmt.Errorf("Error computing upgrade plan: %v", err)
+	}
+
+	printUpgradePlan(plan)
+
+	if config.FileSink.Enabled {
+		sink, err := NewFileSink(config.FileSink)
+		if err != nil {
+			return fmt.Errorf("Error opening file sink: %v", err)
+		}
+		defer sink.Close()
+		if err := sink.ReportUpgradeResult(config, result); err != nil {
+			return fmt.Errorf("Error recording upgrade plan: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -208,10 +365,19 @@ func handlePackageInfo(config *Config, provider PackageInfoProvider, reporter Pa
 		if err != nil {
 			log.Printf("Error getting package info: %v", err)
 		} else {
+			packages = matchVulnerabilities(&config.Vulnerabilities, packages)
+			if config.PackageDetails.Enabled {
+				packages = enrichPackages(config, packages)
+			}
 			err = reporter.ReportPackageInfo(config, packages)
 			if err != nil {
 				log.Printf("Error reporting package info: %v", err)
 			} else {
+				if repoReporter, ok := reporter.(RepositoryReporter); ok {
+					if err := repoReporter.ReportRepositories(config, listRepositories()); err != nil {
+						log.Printf("Error reporting repositories: %v", err)
+					}
+				}
 				err = upgradeChecker.CheckAndPerformUpgrade(config)
 				if err != nil {
 					log.Printf("Error checking and performing upgrade: %v", err)
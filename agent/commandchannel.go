@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	commandStatusAccepted = "accepted"
+
+	commandRetryMin = 5 * time.Second
+	commandRetryMax = 5 * time.Minute
+)
+
+// CommandResult is posted back to the backend once a command has been handled
+type CommandResult struct {
+	CommandID     string         `json:"command_id"`
+	Action        string         `json:"action"`
+	Success       bool           `json:"success"`
+	Error         string         `json:"error,omitempty"`
+	Skipped       string         `json:"skipped,omitempty"` // why the agent did not act on it, e.g. outside a staged rollout
+	FinishedAt    time.Time      `json:"finished_at"`
+	UpgradeResult *UpgradeResult `json:"upgrade_result,omitempty"`
+}
+
+type commandAck struct {
+	CommandID  string    `json:"command_id"`
+	Status     string    `json:"status"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// CommandChannel long-polls the backend for signed instructions and hands the
+// verified ones to the daemon loop. While it is connected the daemon does not
+// need to poll the upgrade endpoint; when it is not, polling takes over.
+type CommandChannel struct {
+	config    *Config
+	verifier  *InstructionVerifier
+	client    *http.Client
+	commands  chan<- *Instruction
+	connected atomic.Bool
+
+	// reconnect backoff, doubling from retryMin up to retryMax
+	retryMin time.Duration
+	retryMax time.Duration
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewCommandChannel(config *Config, verifier *InstructionVerifier, commands chan<- *Instruction) (*CommandChannel, error) {
+	// the backend holds a long-poll request open for up to Wait, so the
+	// regular read and overall timeouts are extended by that much
+	network := config.Network
+	if network.ReadTimeout > 0 {
+		network.ReadTimeout += config.Commands.Wait
+	}
+	if network.Timeout > 0 {
+		network.Timeout += config.Commands.Wait
+	}
+	client, err := newHTTPClient(config.TLS, network)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CommandChannel{
+		config:   config,
+		verifier: verifier,
+		client:   client,
+		commands: commands,
+		retryMin: commandRetryMin,
+		retryMax: commandRetryMax,
+	}, nil
+}
+
+func (c *CommandChannel) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run(ctx)
+	}()
+}
+
+// Stop cancels any in-flight poll and waits for the channel to shut down
+func (c *CommandChannel) Stop() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+	c.connected.Store(false)
+}
+
+func (c *CommandChannel) Connected() bool {
+	return c.connected.Load()
+}
+
+func (c *CommandChannel) run(ctx context.Context) {
+	retry := c.retryMin
+	for ctx.Err() == nil {
+		instructions, err := c.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if c.connected.Swap(false) {
+				log.Printf("Command channel unavailable, falling back to polling: %v\n", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, c.retryMax)
+			continue
+		}
+
+		if !c.connected.Swap(true) {
+			log.Printf("Command channel connected to %s\n", c.config.CommandEndpoint)
+		}
+		retry = c.retryMin
+
+		for _, instruction := range instructions {
+			if err := c.Acknowledge(instruction.ID, commandStatusAccepted); err != nil {
+				log.Printf("Error acknowledging command %s: %v\n", instruction.ID, err)
+			}
+			select {
+			case c.commands <- instruction:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// poll waits for pending commands and returns the ones that pass verification
+func (c *CommandChannel) poll(ctx context.Context) ([]*Instruction, error) {
+	query := url.Values{"wait": {strconv.Itoa(int(c.config.Commands.Wait.Seconds()))}}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.config.CommandEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := doBackendRequestWith(c.config, c.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+
+	var envelopes []json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxInstructionSize*16)).Decode(&envelopes); err != nil {
+		return nil, fmt.Errorf("malformed command list: %v", err)
+	}
+
+	var instructions []*Instruction
+	for _, envelope := range envelopes {
+		instruction, err := c.verifier.Verify(c.config, envelope)
+		if err != nil {
+			log.Printf("Rejected command from %s: %v\n", c.config.CommandEndpoint, err)
+			continue
+		}
+		instructions = append(instructions, instruction)
+	}
+	return instructions, nil
+}
+
+func (c *CommandChannel) Acknowledge(commandID, status string) error {
+	return c.post(fmt.Sprintf("%s/%s/ack", c.config.CommandEndpoint, url.PathEscape(commandID)), commandAck{
+		CommandID:  commandID,
+		Status:     status,
+		ReceivedAt: time.Now().UTC(),
+	})
+}
+
+func (c *CommandChannel) ReportResult(result CommandResult) error {
+	return c.post(fmt.Sprintf("%s/%s/result", c.config.CommandEndpoint, url.PathEscape(result.CommandID)), result)
+}
+
+func (c *CommandChannel) post(endpoint string, payload interface{}) error {
+	resp, err := postJSON(c.config, endpoint, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
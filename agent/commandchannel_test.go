@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// commandBackend is a fake backend serving queued commands to long polls and
+// recording acknowledgements and results
+type commandBackend struct {
+	t          *testing.T
+	mu         sync.Mutex
+	queue      [][]byte // signed instructions served by the next poll
+	failPolls  int      // polls answered with an error before serving the queue
+	pollTimes  []time.Time
+	waits      []string
+	acks       []commandAck
+	results    []CommandResult
+	upgradeGET int
+	upgrade    []byte // signed instruction served by the next upgrade poll
+}
+
+func (b *commandBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/commands":
+		b.pollTimes = append(b.pollTimes, time.Now())
+		b.waits = append(b.waits, r.URL.Query().Get("wait"))
+		if b.failPolls > 0 {
+			b.failPolls--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if len(b.queue) == 0 {
+			// a real backend holds the poll open; don't spin
+			time.Sleep(5 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var list []json.RawMessage
+		for _, instruction := range b.queue {
+			list = append(list, instruction)
+		}
+		b.queue = nil
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/ack"):
+		var ack commandAck
+		if err := json.NewDecoder(r.Body).Decode(&ack); err != nil {
+			b.t.Errorf("invalid ack: %v", err)
+		}
+		if r.URL.Path != "/commands/"+ack.CommandID+"/ack" {
+			b.t.Errorf("ack for %s posted to %s", ack.CommandID, r.URL.Path)
+		}
+		b.acks = append(b.acks, ack)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/result"):
+		var result CommandResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			b.t.Errorf("invalid result: %v", err)
+		}
+		if r.URL.Path != "/commands/"+result.CommandID+"/result" {
+			b.t.Errorf("result for %s posted to %s", result.CommandID, r.URL.Path)
+		}
+		b.results = append(b.results, result)
+	case r.Method == "GET" && r.URL.Path == "/upgrade":
+		b.upgradeGET++
+		if b.upgrade == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(b.upgrade)
+		b.upgrade = nil
+	default:
+		b.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (b *commandBackend) snapshot() commandBackend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return commandBackend{
+		pollTimes:  append([]time.Time(nil), b.pollTimes...),
+		waits:      append([]string(nil), b.waits...),
+		acks:       append([]commandAck(nil), b.acks...),
+		results:    append([]CommandResult(nil), b.results...),
+		upgradeGET: b.upgradeGET,
+	}
+}
+
+// newCommandTestConfig returns a configuration for a backend at url that
+// accepts instructions signed by the returned key
+func newCommandTestConfig(t *testing.T, url string) (*Config, ed25519.PrivateKey) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	config := getTestConfig()
+	config.BackendURL = url
+	config.CommandEndpoint = url + "/commands"
+	config.UpgradeEndpoint = url + "/upgrade"
+	config.AgentID = "agent-1"
+	config.StateDir = t.TempDir()
+	config.TLS.MinVersion = "1.2"
+	config.Commands = CommandConfig{Enabled: true, Wait: 30 * time.Second}
+	config.Instructions.PublicKeys = []ed25519.PublicKey{publicKey}
+	return config, privateKey
+}
+
+func testCommand(id, action string) Instruction {
+	return Instruction{
+		ID:        id,
+		Action:    action,
+		AgentID:   "agent-1",
+		IssuedAt:  time.Now().Add(-time.Minute),
+		ExpiresAt: time.Now().Add(time.Hour),
+		Nonce:     "nonce-" + id,
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCommandChannelPoll(t *testing.T) {
+	backend := &commandBackend{t: t}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	config, key := newCommandTestConfig(t, server.URL)
+
+	unsigned, _ := json.Marshal(SignedInstruction{Payload: "e30=", Signature: "AAAA"})
+	backend.queue = [][]byte{
+		signInstruction(t, key, testCommand("cmd-1", ActionInventory)),
+		unsigned,
+		signInstruction(t, key, testCommand("cmd-2", ActionCancelUpgrade)),
+	}
+
+	commands := make(chan *Instruction)
+	channel, err := NewCommandChannel(config, NewInstructionVerifier(), commands)
+	if err != nil {
+		t.Fatalf("NewCommandChannel() error = %v", err)
+	}
+	channel.Start()
+	defer channel.Stop()
+
+	var received []string
+	for i := 0; i < 2; i++ {
+		select {
+		case instruction := <-commands:
+			received = append(received, instruction.ID)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for commands")
+		}
+	}
+	if strings.Join(received, " ") != "cmd-1 cmd-2" {
+		t.Errorf("expected the verified commands in order, got %v", received)
+	}
+	if !channel.Connected() {
+		t.Errorf("expected the channel to be connected")
+	}
+
+	state := backend.snapshot()
+	if len(state.acks) != 2 || state.acks[0].CommandID != "cmd-1" || state.acks[0].Status != commandStatusAccepted {
+		t.Errorf("expected both commands to be acknowledged, got %+v", state.acks)
+	}
+	if state.waits[0] != "30" {
+		t.Errorf("expected the poll to ask the backend to wait 30s, got %q", state.waits[0])
+	}
+
+	if err := channel.ReportResult(CommandResult{CommandID: "cmd-1", Action: ActionInventory, Success: true}); err != nil {
+		t.Fatalf("ReportResult() error = %v", err)
+	}
+	if results := backend.snapshot().results; len(results) != 1 || !results[0].Success {
+		t.Errorf("expected the result to be posted, got %+v", results)
+	}
+}
+
+func TestCommandChannelReconnect(t *testing.T) {
+	backend := &commandBackend{t: t, failPolls: 3}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	config, _ := newCommandTestConfig(t, server.URL)
+
+	channel, err := NewCommandChannel(config, NewInstructionVerifier(), make(chan *Instruction))
+	if err != nil {
+		t.Fatalf("NewCommandChannel() error = %v", err)
+	}
+	channel.retryMin, channel.retryMax = 20*time.Millisecond, 40*time.Millisecond
+	channel.Start()
+	defer channel.Stop()
+
+	waitFor(t, "the channel to connect", channel.Connected)
+
+	// the retries after the three failures back off 20ms, 40ms, then stay at the 40ms cap
+	polls := backend.snapshot().pollTimes
+	if len(polls) < 4 {
+		t.Fatalf("expected at least 4 polls, got %d", len(polls))
+	}
+	for i, minGap := range []time.Duration{20, 40, 40} {
+		if gap := polls[i+1].Sub(polls[i]); gap < minGap*time.Millisecond {
+			t.Errorf("retry %d after %v, expected at least %v", i+1, gap, minGap*time.Millisecond)
+		}
+	}
+
+	// losing the backend marks the channel disconnected again
+	server.CloseClientConnections()
+	server.Close()
+	waitFor(t, "the channel to disconnect", func() bool { return !channel.Connected() })
+}
+
+func TestDaemonFallsBackToPolling(t *testing.T) {
+	backend := &commandBackend{t: t}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	config, _ := newCommandTestConfig(t, server.URL)
+
+	d := &daemon{
+		config:         config,
+		resultReporter: &DefaultUpgradeResultReporter{},
+		upgradeChecker: &DefaultUpgradeChecker{Verifier: NewInstructionVerifier()},
+		commands:       make(chan *Instruction),
+	}
+
+	// no channel: the upgrade endpoint is polled
+	if err := d.activeUpgradeChecker().CheckAndPerformUpgrade(config); err != nil {
+		t.Fatalf("CheckAndPerformUpgrade() error = %v", err)
+	}
+	if got := backend.snapshot().upgradeGET; got != 1 {
+		t.Errorf("expected the upgrade endpoint to be polled once, got %d", got)
+	}
+
+	d.startCommandChannel()
+	defer d.channel.Stop()
+	waitFor(t, "the channel to connect", d.channel.Connected)
+	if _, ok := d.activeUpgradeChecker().(noopUpgradeChecker); !ok {
+		t.Errorf("expected no upgrade polling while the channel is connected")
+	}
+
+	// disconnected with a pending upgrade, there is nothing to poll for either
+	d.channel.Stop()
+	d.schedulePendingUpgrade(&Instruction{ID: "deferred", NotBefore: time.Now().Add(time.Hour)}, false)
+	if _, ok := d.activeUpgradeChecker().(noopUpgradeChecker); !ok {
+		t.Errorf("expected no upgrade polling while an upgrade is pending")
+	}
+	d.pendingTimer.Stop()
+}
@@ -1,22 +1,56 @@
 package agent
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
 )
 
 type Config struct {
-	BackendURL         string `yaml:"backend_url"`
-	TelemetryEndpoint  string
-	PackageEndpoint    string
-	UpgradeEndpoint    string
-	PollInterval       time.Duration   `yaml:"poll_interval"`
-	UpgradeCheckPeriod time.Duration   `yaml:"upgrade_check_period"`
-	Token              string          `yaml:"token"`
-	Hostname           string          `yaml:"hostname"`
-	DiskUsage          DiskUsageFilter `yaml:"disk_usage"`
+	BackendURL               string `yaml:"backend_url"`
+	TelemetryEndpoint        string
+	TelemetryBatchEndpoint   string
+	PackageEndpoint          string
+	RepositoryEndpoint       string
+	UpgradeEndpoint          string
+	UpgradeResultEndpoint    string
+	EnrollEndpoint           string
+	RotateCredentialEndpoint string
+	CommandEndpoint          string
+	RemoteConfigEndpoint     string
+	PollInterval             time.Duration         `yaml:"poll_interval"`
+	UpgradeCheckPeriod       time.Duration         `yaml:"upgrade_check_period"`
+	Token                    string                `yaml:"token"` // replaced by the enrolled credential when present
+	AgentID                  string                // set once the host is enrolled
+	StateDir                 string                `yaml:"state_dir"`
+	Hostname                 string                `yaml:"hostname"`
+	DiskUsage                DiskUsageFilter       `yaml:"disk_usage"`
+	FileSink                 FileSinkConfig        `yaml:"file_sink"`
+	Upload                   UploadConfig          `yaml:"upload"`
+	TLS                      TLSConfig             `yaml:"tls"`
+	Network                  NetworkConfig         `yaml:"network"`
+	Instructions             InstructionConfig     `yaml:"instructions"`
+	Commands                 CommandConfig         `yaml:"commands"`
+	RemoteConfig             RemoteConfigSettings  `yaml:"remote_config"`
+	Hooks                    HooksConfig           `yaml:"hooks"`
+	Reboot                   RebootConfig          `yaml:"reboot"`
+	Services                 ServicesConfig        `yaml:"services"`
+	Rollout                  RolloutConfig         `yaml:"rollout"`
+	Snapshot                 SnapshotConfig        `yaml:"snapshot"`
+	Upgrades                 UpgradesConfig        `yaml:"upgrades"`
+	Vulnerabilities          VulnerabilitiesConfig `yaml:"vulnerabilities"`
+	PackageDetails           PackageDetailsConfig  `yaml:"package_details"`
+	Packages                 PackagesConfig        `yaml:"packages"`
+	RemoteConfigVersion      string                // version of the applied remote overlay, if any
+
+	// HTTPClient is built from TLS and Network by LoadConfig and used for every backend request
+	HTTPClient *http.Client
 }
 
 type DiskUsageFilter struct {
@@ -24,12 +58,145 @@ type DiskUsageFilter struct {
 	Mountpoints []string
 }
 
+// FileSinkConfig controls the local JSON Lines sink used on hosts without a route to the backend
+type FileSinkConfig struct {
+	Enabled    bool
+	Path       string
+	MaxSize    int64         // bytes
+	MaxAge     time.Duration // zero disables age-based rotation
+	MaxBackups int           // zero keeps every rotated file
+	Compress   bool
+}
+
+// UploadConfig controls how payloads are sent to the backend. Both options
+// must be supported by the backend, so they are off by default.
+type UploadConfig struct {
+	Compression string // "", "gzip" or "zstd"
+	Batch       bool
+	MaxBatch    int
+}
+
+// TLSConfig holds the trust and client certificate settings for the backend connection
+type TLSConfig struct {
+	CAFile       string // replaces the system roots when set
+	CertFile     string
+	KeyFile      string
+	MinVersion   string // "1.0", "1.1", "1.2" or "1.3"
+	ServerName   string
+	PinnedSHA256 []string // SHA-256 of the subject public key info of a certificate in the chain
+}
+
+// NetworkConfig holds the timeouts and proxy applied to every backend request
+type NetworkConfig struct {
+	ConnectTimeout time.Duration // dialing and TLS handshake
+	ReadTimeout    time.Duration // waiting for response headers
+	Timeout        time.Duration // whole request, including reading the body
+	Proxy          ProxyConfig
+}
+
+// ProxyConfig selects an explicit proxy. When URL is empty the standard
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+type ProxyConfig struct {
+	URL      string
+	NoProxy  []string // defaults to NO_PROXY from the environment
+	Username string
+	Password string
+}
+
+// InstructionConfig holds the keys that backend instructions must be signed with
+type InstructionConfig struct {
+	PublicKeys []ed25519.PublicKey
+	// AllowUnsigned restores the legacy behaviour of upgrading on any 200
+	// response from the upgrade endpoint. Only for backends that cannot sign.
+	AllowUnsigned bool
+}
+
+// CommandConfig controls the long-poll channel the backend uses to push commands
+type CommandConfig struct {
+	Enabled bool
+	Wait    time.Duration // how long the backend may hold a poll open
+}
+
+// RemoteConfigSettings controls the configuration overlay served by the backend
+type RemoteConfigSettings struct {
+	Enabled  bool
+	Interval time.Duration // how often to check for a new overlay
+	Locked   []string      // keys the overlay may not override
+}
+
+// HooksConfig holds shell commands run around every upgrade
+type HooksConfig struct {
+	PreUpgrade        []string
+	PostUpgrade       []string
+	Timeout           time.Duration // per hook, zero for none
+	AbortOnPreFailure bool
+}
+
+// RebootConfig controls whether the daemon reboots the host when upgrades require it
+type RebootConfig struct {
+	Policy  string // "never", "if_required" or "maintenance_window"
+	Window  MaintenanceWindow
+	Warning time.Duration // advance notice for logged-in users
+	Message string        // broadcast to logged-in users
+}
+
+// ServicesConfig controls the check for services still running replaced code after an upgrade
+type ServicesConfig struct {
+	Check   bool
+	Restart []string // units restarted automatically, shell patterns like "php*-fpm.service"
+}
+
+// RolloutConfig places the host in a staged rollout
+type RolloutConfig struct {
+	Group string // ring or group label, e.g. "canary"
+}
+
+// SnapshotConfig controls the root filesystem snapshot taken before upgrades
+type SnapshotConfig struct {
+	Enabled        bool
+	Retention      int    // agent-created snapshots to keep, zero keeps all
+	AbortOnFailure bool   // skip the upgrade if the snapshot fails
+	BtrfsDir       string // where btrfs snapshots of / are created
+	LVMSize        string // copy-on-write space, e.g. "5G" or "10%ORIGIN"
+}
+
+// UpgradesConfig controls how the daemon runs upgrades without a terminal
+type UpgradesConfig struct {
+	Conffiles    string        // "keep" or "new", for modified configuration files during apt upgrades
+	HelperSocket string        // where `redt-agent helper` listens, empty to use sudo
+	HelperUsers  []string      // users allowed to use the helper, besides root
+	LockTimeout  time.Duration // how long to wait for another package manager run to finish
+	Policy       string        // "all", or "critical_cves" to only upgrade packages fixing critical CVEs
+}
+
+// VulnerabilitiesConfig points to an offline vulnerability feed matched against packages
+type VulnerabilitiesConfig struct {
+	Feed      string // OSV JSON file or directory of files, empty to disable
+	Ecosystem string // OSV ecosystem like "Debian:12", detected from /etc/os-release if empty
+	Installed bool   // also report vulnerable installed packages without an update
+}
+
+// PackageDetailsConfig controls fetching changelogs and advisories for pending updates
+type PackageDetailsConfig struct {
+	Enabled bool
+	MaxSize int // bytes of changelog kept per package
+}
+
+// PackagesConfig is the desired package state of the host
+type PackagesConfig struct {
+	MustHave    []string // packages that must be installed
+	MustNotHave []string // packages that must not be installed
+	Remediate   bool     // install and remove packages to fix drift, instead of only reporting it
+}
+
 // type DiskUsageFilter struct {
 // 	FSTypes     []string `yaml:"fstypes"`
 // 	Mountpoints []string `yaml:"mountpoints"`
 // }
 
 func LoadConfig() (*Config, error) {
+	// start from scratch so that a reload drops settings of a previous remote overlay
+	viper.Reset()
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
@@ -39,26 +206,277 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	viper.SetDefault("state_dir", "/var/lib/redt-agent")
+	stateDir := viper.GetString("state_dir")
+
+	viper.SetDefault("remote_config.interval", 15)
+	remoteConfig := RemoteConfigSettings{
+		Enabled:  viper.GetBool("remote_config.enabled"),
+		Interval: viper.GetDuration("remote_config.interval") * time.Minute,
+		Locked:   viper.GetStringSlice("remote_config.locked"),
+	}
+	var remoteConfigVersion string
+	if remoteConfig.Enabled {
+		overlay, err := loadRemoteConfig(stateDir)
+		if err != nil {
+			log.Printf("Not using remote config: %v", err)
+		} else if overlay != nil {
+			applyRemoteConfig(overlay, remoteConfig.Locked)
+			remoteConfigVersion = overlay.Version
+		}
+	}
+
+	viper.SetDefault("poll_interval", 60)
+	viper.SetDefault("upgrade_check_period", 5)
 	backendURL := viper.GetString("backend_url")
 	pollInterval := viper.GetDuration("poll_interval") * time.Second
+	if pollInterval <= 0 {
+		return nil, fmt.Errorf("poll_interval must be positive, got %v", viper.Get("poll_interval"))
+	}
 	upgradeCheckPeriod := viper.GetDuration("upgrade_check_period") * time.Minute
 	token := viper.GetString("token")
 	hostname := viper.GetString("hostname")
 	diskUsageFSTypes := viper.GetStringSlice("disk_usage.fstypes")
 	diskUsageMountpoints := viper.GetStringSlice("disk_usage.mountpoints")
 
+	viper.SetDefault("file_sink.path", "/var/log/redt-agent/records.jsonl")
+	viper.SetDefault("file_sink.max_size", 10)
+	viper.SetDefault("file_sink.max_backups", 7)
+	viper.SetDefault("file_sink.compress", true)
+
+	viper.SetDefault("upload.max_batch", 50)
+	compression := viper.GetString("upload.compression")
+	switch compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported upload.compression %q", compression)
+	}
+
+	viper.SetDefault("tls.min_version", "1.2")
+	tlsConfig := TLSConfig{
+		CAFile:       viper.GetString("tls.ca_file"),
+		CertFile:     viper.GetString("tls.cert_file"),
+		KeyFile:      viper.GetString("tls.key_file"),
+		MinVersion:   viper.GetString("tls.min_version"),
+		ServerName:   viper.GetString("tls.server_name"),
+		PinnedSHA256: viper.GetStringSlice("tls.pinned_sha256"),
+	}
+	viper.SetDefault("network.connect_timeout", 10)
+	viper.SetDefault("network.read_timeout", 30)
+	viper.SetDefault("network.timeout", 60)
+	networkConfig := NetworkConfig{
+		ConnectTimeout: viper.GetDuration("network.connect_timeout") * time.Second,
+		ReadTimeout:    viper.GetDuration("network.read_timeout") * time.Second,
+		Timeout:        viper.GetDuration("network.timeout") * time.Second,
+		Proxy: ProxyConfig{
+			URL:      viper.GetString("network.proxy.url"),
+			NoProxy:  viper.GetStringSlice("network.proxy.no_proxy"),
+			Username: viper.GetString("network.proxy.username"),
+			Password: viper.GetString("network.proxy.password"),
+		},
+	}
+
+	httpClient, err := newHTTPClient(tlsConfig, networkConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend connection settings: %w", err)
+	}
+
+	publicKeys, err := parsePublicKeys(viper.GetStringSlice("instructions.public_keys"))
+	if err != nil {
+		return nil, err
+	}
+
+	viper.SetDefault("commands.wait", 30)
+
+	viper.SetDefault("hooks.timeout", 300)
+	viper.SetDefault("hooks.abort_on_pre_failure", true)
+
+	viper.SetDefault("reboot.policy", RebootNever)
+	viper.SetDefault("reboot.warning", 10)
+	viper.SetDefault("reboot.window.start", "02:00")
+	viper.SetDefault("reboot.window.end", "04:00")
+	rebootPolicy := viper.GetString("reboot.policy")
+	switch rebootPolicy {
+	case RebootNever, RebootIfRequired, RebootMaintenanceWindow:
+	default:
+		return nil, fmt.Errorf("unsupported reboot.policy %q", rebootPolicy)
+	}
+	rebootWindow, err := parseMaintenanceWindow(
+		viper.GetStringSlice("reboot.window.days"),
+		viper.GetString("reboot.window.start"),
+		viper.GetString("reboot.window.end"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reboot.window: %w", err)
+	}
+
+	viper.SetDefault("services.check", true)
+
+	viper.SetDefault("snapshot.retention", 3)
+	viper.SetDefault("snapshot.abort_on_failure", true)
+	viper.SetDefault("snapshot.btrfs_dir", "/.snapshots")
+	viper.SetDefault("snapshot.lvm_size", "10%ORIGIN")
+
+	viper.SetDefault("upgrades.conffiles", ConffilesKeep)
+	viper.SetDefault("upgrades.lock_timeout", 600)
+	conffiles := viper.GetString("upgrades.conffiles")
+	switch conffiles {
+	case ConffilesKeep, ConffilesNew:
+	default:
+		return nil, fmt.Errorf("unsupported upgrades.conffiles %q", conffiles)
+	}
+	viper.SetDefault("upgrades.policy", UpgradePolicyAll)
+	upgradePolicy := viper.GetString("upgrades.policy")
+	switch upgradePolicy {
+	case UpgradePolicyAll:
+	case UpgradePolicyCriticalCVEs:
+		if viper.GetString("vulnerabilities.feed") == "" {
+			return nil, fmt.Errorf("upgrades.policy %q needs vulnerabilities.feed", upgradePolicy)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upgrades.policy %q", upgradePolicy)
+	}
+
+	viper.SetDefault("vulnerabilities.installed", true)
+
+	viper.SetDefault("package_details.max_size", 8)
+
+	mustHave := viper.GetStringSlice("packages.must_have")
+	mustNotHave := viper.GetStringSlice("packages.must_not_have")
+	for _, name := range mustHave {
+		if slices.Contains(mustNotHave, name) {
+			return nil, fmt.Errorf("package %q is in both packages.must_have and packages.must_not_have", name)
+		}
+	}
+
+	var agentID string
+	creds, err := loadCredentials(stateDir)
+	if err != nil {
+		// e.g. a non-root user running one-shot mode; fall back to the configured token
+		log.Printf("Not using enrolled credential: %v", err)
+	} else if creds != nil {
+		agentID = creds.AgentID
+		token = creds.Credential
+	}
+
 	return &Config{
-		BackendURL:         backendURL,
-		TelemetryEndpoint:  backendURL + "/telemetry",
-		PackageEndpoint:    backendURL + "/packages",
-		UpgradeEndpoint:    backendURL + "/upgrade",
-		PollInterval:       pollInterval,
-		UpgradeCheckPeriod: upgradeCheckPeriod,
-		Token:              token,
-		Hostname:           hostname,
+		BackendURL:               backendURL,
+		TelemetryEndpoint:        backendURL + "/telemetry",
+		TelemetryBatchEndpoint:   backendURL + "/telemetry/batch",
+		PackageEndpoint:          backendURL + "/packages",
+		RepositoryEndpoint:       backendURL + "/repositories",
+		UpgradeEndpoint:          backendURL + "/upgrade",
+		UpgradeResultEndpoint:    backendURL + "/upgrade/result",
+		EnrollEndpoint:           backendURL + "/enroll",
+		RotateCredentialEndpoint: backendURL + "/credentials/rotate",
+		CommandEndpoint:          backendURL + "/commands",
+		RemoteConfigEndpoint:     backendURL + "/config",
+		PollInterval:             pollInterval,
+		UpgradeCheckPeriod:       upgradeCheckPeriod,
+		Token:                    token,
+		AgentID:                  agentID,
+		StateDir:                 stateDir,
+		Hostname:                 hostname,
 		DiskUsage: DiskUsageFilter{
 			FSTypes:     diskUsageFSTypes,
 			Mountpoints: diskUsageMountpoints,
 		},
+		FileSink: FileSinkConfig{
+			Enabled:    viper.GetBool("file_sink.enabled"),
+			Path:       viper.GetString("file_sink.path"),
+			MaxSize:    viper.GetInt64("file_sink.max_size") * 1024 * 1024,
+			MaxAge:     viper.GetDuration("file_sink.max_age") * time.Hour,
+			MaxBackups: viper.GetInt("file_sink.max_backups"),
+			Compress:   viper.GetBool("file_sink.compress"),
+		},
+		Upload: UploadConfig{
+			Compression: compression,
+			Batch:       viper.GetBool("upload.batch"),
+			MaxBatch:    viper.GetInt("upload.max_batch"),
+		},
+		TLS:        tlsConfig,
+		Network:    networkConfig,
+		HTTPClient: httpClient,
+		Instructions: InstructionConfig{
+			PublicKeys:    publicKeys,
+			AllowUnsigned: viper.GetBool("instructions.allow_unsigned"),
+		},
+		Commands: CommandConfig{
+			Enabled: viper.GetBool("commands.enabled"),
+			Wait:    viper.GetDuration("commands.wait") * time.Second,
+		},
+		RemoteConfig:        remoteConfig,
+		RemoteConfigVersion: remoteConfigVersion,
+		Hooks: HooksConfig{
+			PreUpgrade:        viper.GetStringSlice("hooks.pre_upgrade"),
+			PostUpgrade:       viper.GetStringSlice("hooks.post_upgrade"),
+			Timeout:           viper.GetDuration("hooks.timeout") * time.Second,
+			AbortOnPreFailure: viper.GetBool("hooks.abort_on_pre_failure"),
+		},
+		Reboot: RebootConfig{
+			Policy:  rebootPolicy,
+			Window:  rebootWindow,
+			Warning: viper.GetDuration("reboot.warning") * time.Minute,
+			Message: viper.GetString("reboot.message"),
+		},
+		Services: ServicesConfig{
+			Check:   viper.GetBool("services.check"),
+			Restart: viper.GetStringSlice("services.restart"),
+		},
+		Rollout: RolloutConfig{
+			Group: viper.GetString("rollout.group"),
+		},
+		Snapshot: SnapshotConfig{
+			Enabled:        viper.GetBool("snapshot.enabled"),
+			Retention:      viper.GetInt("snapshot.retention"),
+			AbortOnFailure: viper.GetBool("snapshot.abort_on_failure"),
+			BtrfsDir:       viper.GetString("snapshot.btrfs_dir"),
+			LVMSize:        viper.GetString("snapshot.lvm_size"),
+		},
+		Upgrades: UpgradesConfig{
+			Conffiles:    conffiles,
+			HelperSocket: viper.GetString("upgrades.helper_socket"),
+			HelperUsers:  viper.GetStringSlice("upgrades.helper_users"),
+			LockTimeout:  viper.GetDuration("upgrades.lock_timeout") * time.Second,
+			Policy:       upgradePolicy,
+		},
+		Vulnerabilities: VulnerabilitiesConfig{
+			Feed:      viper.GetString("vulnerabilities.feed"),
+			Ecosystem: viper.GetString("vulnerabilities.ecosystem"),
+			Installed: viper.GetBool("vulnerabilities.installed"),
+		},
+		PackageDetails: PackageDetailsConfig{
+			Enabled: viper.GetBool("package_details.enabled"),
+			MaxSize: viper.GetInt("package_details.max_size") * 1024,
+		},
+		Packages: PackagesConfig{
+			MustHave:    mustHave,
+			MustNotHave: mustNotHave,
+			Remediate:   viper.GetBool("packages.remediate"),
+		},
 	}, nil
 }
+
+// redacted returns a copy of the configuration that is safe to log, with the
+// token or enrolled credential masked
+func (c *Config) redacted() Config {
+	credentialMu.RLock()
+	redacted := *c
+	credentialMu.RUnlock()
+	if redacted.Token != "" {
+		redacted.Token = "[redacted]"
+	}
+	if redacted.Network.Proxy.Password != "" {
+		redacted.Network.Proxy.Password = "[redacted]"
+	}
+	if redacted.Network.Proxy.URL != "" {
+		// the proxy URL may carry credentials as user:pass@
+		if u, err := url.Parse(redacted.Network.Proxy.URL); err != nil {
+			redacted.Network.Proxy.URL = "[redacted]"
+		} else if u.User != nil {
+			u.User = nil
+			redacted.Network.Proxy.URL = u.String()
+		}
+	}
+	return redacted
+}
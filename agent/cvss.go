@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// cvssV3Weights are the CVSS v3 base metric values, by metric and value
+var cvssV3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvssV3BaseScore computes the base score of a CVSS v3.0 or v3.1 vector such
+// as CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H, which is what OSV carries
+// in severity[].score
+func cvssV3BaseScore(vector string) (float64, error) {
+	parts := strings.Split(vector, "/")
+	if parts[0] != "CVSS:3.0" && parts[0] != "CVSS:3.1" {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %q", vector)
+	}
+
+	metrics := make(map[string]string)
+	for _, part := range parts[1:] {
+		metric, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return 0, fmt.Errorf("invalid CVSS metric %q", part)
+		}
+		metrics[metric] = value
+	}
+
+	scopeChanged := false
+	switch metrics["S"] {
+	case "U":
+	case "C":
+		scopeChanged = true
+	default:
+		return 0, fmt.Errorf("invalid CVSS scope %q", metrics["S"])
+	}
+
+	weights := make(map[string]float64)
+	for metric, values := range cvssV3Weights {
+		weight, ok := values[metrics[metric]]
+		if !ok {
+			return 0, fmt.Errorf("invalid or missing CVSS metric %s in %q", metric, vector)
+		}
+		weights[metric] = weight
+	}
+	// privileges weigh more when the scope changes
+	if scopeChanged && metrics["PR"] == "L" {
+		weights["PR"] = 0.68
+	} else if scopeChanged && metrics["PR"] == "H" {
+		weights["PR"] = 0.5
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+	impact := 6.42 * iss
+	if scopeChanged {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * weights["PR"] * weights["UI"]
+
+	if scopeChanged {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return cvssRoundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// cvssRoundUp rounds up to one decimal as CVSS v3.1 specifies, avoiding
+// floating point artifacts such as 4.000000001 rounding up to 4.1
+func cvssRoundUp(x float64) float64 {
+	i := math.Round(x * 100000)
+	if math.Mod(i, 10000) == 0 {
+		return i / 100000
+	}
+	return (math.Floor(i/10000) + 1) / 10
+}
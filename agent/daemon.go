@@ -0,0 +1,381 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// daemon holds the state of the RunDaemon loop. Everything that acts on the
+// system runs on the loop's goroutine; the command channel only feeds it.
+type daemon struct {
+	config           *Config
+	telemetrySender  TelemetryDataSender
+	packageReporter  PackageInfoReporter
+	resultReporter   UpgradeResultReporter
+	upgradeChecker   *DefaultUpgradeChecker
+	lastUpgradeCheck time.Time
+	// last time drift from the desired package state was remediated
+	lastRemediation time.Time
+	// last time the backend was asked for a remote config overlay
+	lastRemoteConfigCheck time.Time
+
+	ticker   *time.Ticker
+	commands chan *Instruction
+	channel  *CommandChannel
+
+	// an upgrade with a NotBefore in the future waits here until due or
+	// cancelled, whether it was polled or arrived as a command
+	pendingUpgrade *Instruction
+	pendingTimer   *time.Timer
+	// whether the pending upgrade arrived as a command, whose outcome is also
+	// reported as a command result
+	pendingCommand bool
+
+	// set once shutdown has accepted a reboot, so it is not scheduled again
+	// until it is overdue
+	rebootScheduledAt time.Time
+
+	store *StateStore
+}
+
+func (d *daemon) run() {
+	d.upgradeChecker.Defer = d.deferPolledUpgrade
+	d.restoreState()
+	d.syncRemoteConfig()
+
+	if d.config.Commands.Enabled && d.config.BackendURL != "" {
+		d.startCommandChannel()
+	}
+	defer func() {
+		if d.channel != nil {
+			d.channel.Stop()
+		}
+	}()
+
+	d.ticker = time.NewTicker(d.config.PollInterval)
+	defer d.ticker.Stop()
+	for {
+		select {
+		case <-d.ticker.C:
+			d.tick()
+		case instruction := <-d.commands:
+			d.handleCommand(instruction)
+		case <-d.pendingC():
+			d.runPendingUpgrade()
+		}
+		d.saveState()
+	}
+}
+
+func (d *daemon) tick() {
+	d.syncRemoteConfig()
+	handleTelemetry(d.config, &DefaultTelemetryDataProvider{}, d.telemetrySender)
+
+	d.lastUpgradeCheck = handlePackageInfo(d.config, &DefaultPackageInfoProvider{}, d.packageReporter, d.lastUpgradeCheck, d.activeUpgradeChecker())
+	if d.config.Packages.Remediate && time.Since(d.lastRemediation) >= d.config.UpgradeCheckPeriod {
+		remediatePackages(d.config, d.resultReporter)
+		d.lastRemediation = time.Now()
+	}
+	d.checkReboot()
+}
+
+// activeUpgradeChecker polls the upgrade endpoint unless upgrade instructions
+// arrive over a connected command channel. While an upgrade is pending the
+// backend is not polled for another one.
+func (d *daemon) activeUpgradeChecker() UpgradeChecker {
+	if d.pendingUpgrade != nil || d.channel != nil && d.channel.Connected() {
+		return noopUpgradeChecker{}
+	}
+	return d.upgradeChecker
+}
+
+// restoreState picks up where the previous run of the daemon left off
+func (d *daemon) restoreState() {
+	state := d.store.State()
+
+	// without a previous check, check right away
+	if !state.LastUpgradeCheck.IsZero() {
+		d.lastUpgradeCheck = state.LastUpgradeCheck
+	}
+	d.lastRemoteConfigCheck = state.LastRemoteConfigCheck
+	d.upgradeChecker.Verifier.RestoreSeenNonces(state.SeenNonces)
+	if sender, ok := d.telemetrySender.(*DefaultTelemetryDataSender); ok {
+		sender.backlog = state.TelemetryBacklog
+		sender.lastSent = state.LastTelemetrySent
+	}
+	if pending := state.PendingUpgrade; pending != nil {
+		// verified when received, but it may have expired while the agent was down
+		if time.Now().Before(pending.ExpiresAt) {
+			d.schedulePendingUpgrade(pending, state.PendingUpgradeCommand)
+		} else {
+			log.Printf("Dropping pending upgrade %s: expired at %s\n", pending.ID, pending.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// saveState persists the state needed to resume after a restart
+func (d *daemon) saveState() {
+	err := d.store.Update(func(state *AgentState) {
+		state.LastUpgradeCheck = d.lastUpgradeCheck
+		state.LastRemoteConfigCheck = d.lastRemoteConfigCheck
+		state.SeenNonces = d.upgradeChecker.Verifier.SeenNonces()
+		if sender, ok := d.telemetrySender.(*DefaultTelemetryDataSender); ok {
+			state.TelemetryBacklog = sender.backlog
+			state.LastTelemetrySent = sender.lastSent
+		}
+		state.PendingUpgrade = d.pendingUpgrade
+		state.PendingUpgradeCommand = d.pendingCommand
+	})
+	if err != nil {
+		log.Printf("Error saving agent state: %v\n", err)
+	}
+}
+
+// checkReboot reboots the host if an upgrade requires it and the reboot policy allows it now
+func (d *daemon) checkReboot() {
+	if d.config.Reboot.Policy == RebootNever {
+		return
+	}
+
+	status := detectRebootRequired()
+	if !d.rebootScheduledAt.IsZero() {
+		// an admin may have cancelled the reboot with shutdown -c, or resolved
+		// what required it
+		if !status.Required {
+			d.rebootScheduledAt = time.Time{}
+			return
+		}
+		if time.Since(d.rebootScheduledAt) < d.config.Reboot.Warning+rebootGracePeriod {
+			return
+		}
+		log.Printf("Reboot scheduled at %s did not happen\n", d.rebootScheduledAt.Format(time.RFC3339))
+		d.rebootScheduledAt = time.Time{}
+	}
+
+	if !rebootDue(&d.config.Reboot, status, time.Now()) {
+		return
+	}
+	if err := scheduleReboot(&d.config.Reboot, status); err != nil {
+		log.Printf("Error rebooting: %v\n", err)
+		return
+	}
+	d.rebootScheduledAt = time.Now()
+}
+
+func (d *daemon) startCommandChannel() {
+	channel, err := NewCommandChannel(d.config, d.upgradeChecker.Verifier, d.commands)
+	if err != nil {
+		log.Printf("Error starting command channel, using polling only: %v\n", err)
+		d.channel = nil
+		return
+	}
+	d.channel = channel
+	d.channel.Start()
+}
+
+func (d *daemon) handleCommand(instruction *Instruction) {
+	log.Printf("Received command %s: %s\n", instruction.ID, instruction.Action)
+
+	result := CommandResult{
+		CommandID: instruction.ID,
+		Action:    instruction.Action,
+	}
+
+	var err error
+	switch instruction.Action {
+	case ActionInventory:
+		handleTelemetry(d.config, &DefaultTelemetryDataProvider{}, d.telemetrySender)
+		err = d.reportInventory()
+	case ActionUpgrade:
+		if reason := applyRollout(d.config, instruction); reason != "" {
+			log.Printf("Skipping upgrade command %s: %s\n", instruction.ID, reason)
+			result.Skipped = reason
+			break
+		}
+		if instruction.NotBefore.After(time.Now()) {
+			d.schedulePendingUpgrade(instruction, true)
+			// the result is reported once the upgrade has run or been cancelled
+			return
+		}
+		var upgradeResult UpgradeResult
+		upgradeResult, err = runInstructedUpgrade(d.config, instruction, d.resultReporter)
+		result.UpgradeResult = &upgradeResult
+		defer d.checkReboot()
+	case ActionRollback:
+		var upgradeResult UpgradeResult
+		upgradeResult, err = runInstructedRollback(d.config, instruction, d.resultReporter)
+		result.UpgradeResult = &upgradeResult
+		defer d.checkReboot()
+	case ActionInstall, ActionRemove:
+		var upgradeResult UpgradeResult
+		upgradeResult, err = runInstructedPackageChange(d.config, instruction, d.resultReporter)
+		result.UpgradeResult = &upgradeResult
+		defer d.checkReboot()
+	case ActionCancelUpgrade:
+		err = d.cancelPendingUpgrade()
+	case ActionRefreshConfig:
+		err = d.refreshConfig()
+	default:
+		err = fmt.Errorf("unsupported action %q", instruction.Action)
+	}
+
+	d.reportCommandResult(result, err)
+}
+
+func (d *daemon) reportInventory() error {
+	packages, err := (&DefaultPackageInfoProvider{}).GetPackageInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get package info: %v", err)
+	}
+	packages = matchVulnerabilities(&d.config.Vulnerabilities, packages)
+	if d.config.PackageDetails.Enabled {
+		packages = enrichPackages(d.config, packages)
+	}
+	if err := d.packageReporter.ReportPackageInfo(d.config, packages); err != nil {
+		return err
+	}
+	if repoReporter, ok := d.packageReporter.(RepositoryReporter); ok {
+		return repoReporter.ReportRepositories(d.config, listRepositories())
+	}
+	return nil
+}
+
+func (d *daemon) schedulePendingUpgrade(instruction *Instruction, fromCommand bool) {
+	if d.pendingUpgrade != nil {
+		d.finishPendingUpgrade(nil, fmt.Errorf("superseded by %s", instruction.ID))
+	}
+
+	log.Printf("Upgrade %s pending until %s\n", instruction.ID, instruction.NotBefore.Format(time.RFC3339))
+	d.pendingUpgrade = instruction
+	d.pendingCommand = fromCommand
+	d.pendingTimer = time.NewTimer(time.Until(instruction.NotBefore))
+}
+
+// deferPolledUpgrade keeps an upgrade from the upgrade endpoint until it is due
+func (d *daemon) deferPolledUpgrade(instruction *Instruction) {
+	d.schedulePendingUpgrade(instruction, false)
+}
+
+func (d *daemon) runPendingUpgrade() {
+	if expiresAt := d.pendingUpgrade.ExpiresAt; !time.Now().Before(expiresAt) {
+		d.finishPendingUpgrade(nil, fmt.Errorf("expired at %s", expiresAt.Format(time.RFC3339)))
+		return
+	}
+	upgradeResult, err := runInstructedUpgrade(d.config, d.pendingUpgrade, d.resultReporter)
+	d.finishPendingUpgrade(&upgradeResult, err)
+	d.checkReboot()
+}
+
+func (d *daemon) cancelPendingUpgrade() error {
+	if d.pendingUpgrade == nil {
+		return fmt.Errorf("no pending upgrade")
+	}
+
+	log.Printf("Cancelled pending upgrade %s\n", d.pendingUpgrade.ID)
+	d.finishPendingUpgrade(nil, fmt.Errorf("cancelled"))
+	return nil
+}
+
+// finishPendingUpgrade empties the pending upgrade slot, reporting the
+// outcome if the upgrade arrived as a command
+func (d *daemon) finishPendingUpgrade(upgradeResult *UpgradeResult, err error) {
+	d.pendingTimer.Stop()
+	if d.pendingCommand {
+		d.reportCommandResult(CommandResult{
+			CommandID:     d.pendingUpgrade.ID,
+			Action:        ActionUpgrade,
+			UpgradeResult: upgradeResult,
+		}, err)
+	} else if upgradeResult == nil {
+		log.Printf("Pending upgrade %s dropped: %v\n", d.pendingUpgrade.ID, err)
+	}
+	d.pendingUpgrade, d.pendingTimer, d.pendingCommand = nil, nil, false
+}
+
+// pendingC returns the pending upgrade's timer channel, or nil (blocking forever) when there is none
+func (d *daemon) pendingC() <-chan time.Time {
+	if d.pendingTimer == nil {
+		return nil
+	}
+	return d.pendingTimer.C
+}
+
+// syncRemoteConfig fetches the remote config overlay when due, and reloads
+// the configuration if it changed
+func (d *daemon) syncRemoteConfig() {
+	if !d.config.RemoteConfig.Enabled || d.config.BackendURL == "" {
+		return
+	}
+	if time.Since(d.lastRemoteConfigCheck) < d.config.RemoteConfig.Interval {
+		return
+	}
+	d.lastRemoteConfigCheck = time.Now()
+
+	changed, err := fetchRemoteConfig(d.config)
+	if err != nil {
+		log.Printf("Error checking for remote config: %v\n", err)
+		return
+	}
+	if changed {
+		if err := d.reloadConfig(); err != nil {
+			log.Printf("Error applying remote config: %v\n", err)
+		}
+	}
+}
+
+// refreshConfig fetches the remote config overlay, if enabled, and reloads the configuration
+func (d *daemon) refreshConfig() error {
+	if d.config.RemoteConfig.Enabled && d.config.BackendURL != "" {
+		d.lastRemoteConfigCheck = time.Now()
+		if _, err := fetchRemoteConfig(d.config); err != nil {
+			return err
+		}
+	}
+	return d.reloadConfig()
+}
+
+// reloadConfig reloads the configuration file and remote overlay. The command
+// channel is stopped while the configuration is swapped, since it shares it.
+func (d *daemon) reloadConfig() error {
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	if d.channel != nil {
+		d.channel.Stop()
+		d.channel = nil
+	}
+	*d.config = *config
+	log.Printf("Reloaded configuration (remote version %q): %v", d.config.RemoteConfigVersion, d.config.redacted())
+	if d.ticker != nil {
+		d.ticker.Reset(d.config.PollInterval)
+	}
+	if d.config.Commands.Enabled && d.config.BackendURL != "" {
+		d.startCommandChannel()
+	}
+	return nil
+}
+
+func (d *daemon) reportCommandResult(result CommandResult, err error) {
+	result.FinishedAt = time.Now().UTC()
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("Command %s (%s) failed: %v\n", result.CommandID, result.Action, err)
+	}
+
+	if d.channel == nil {
+		return
+	}
+	if err := d.channel.ReportResult(result); err != nil {
+		log.Printf("Error reporting result of command %s: %v\n", result.CommandID, err)
+	}
+}
+
+type noopUpgradeChecker struct{}
+
+func (noopUpgradeChecker) CheckAndPerformUpgrade(config *Config) error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestDaemon returns a daemon whose command channel is connected to
+// backend, and the key its instructions must be signed with
+func newTestDaemon(t *testing.T, backend *commandBackend) (*daemon, ed25519.PrivateKey) {
+	t.Helper()
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+	config, key := newCommandTestConfig(t, server.URL)
+	d := &daemon{
+		config:         config,
+		resultReporter: &DefaultUpgradeResultReporter{},
+		upgradeChecker: &DefaultUpgradeChecker{Verifier: NewInstructionVerifier()},
+		commands:       make(chan *Instruction),
+	}
+	d.upgradeChecker.Defer = d.deferPolledUpgrade
+	d.startCommandChannel()
+	t.Cleanup(d.channel.Stop)
+	waitFor(t, "the channel to connect", d.channel.Connected)
+	return d, key
+}
+
+func TestCancelPolledUpgrade(t *testing.T) {
+	backend := &commandBackend{t: t}
+	d, key := newTestDaemon(t, backend)
+
+	deferred := testCommand("polled-1", ActionUpgrade)
+	deferred.NotBefore = time.Now().Add(time.Hour)
+	backend.mu.Lock()
+	backend.upgrade = signInstruction(t, key, deferred)
+	backend.mu.Unlock()
+
+	if err := d.upgradeChecker.CheckAndPerformUpgrade(d.config); err != nil {
+		t.Fatalf("CheckAndPerformUpgrade() error = %v", err)
+	}
+	if d.pendingUpgrade == nil || d.pendingUpgrade.ID != "polled-1" || d.pendingCommand {
+		t.Fatalf("expected the polled upgrade in the pending slot, got %+v", d.pendingUpgrade)
+	}
+
+	d.handleCommand(&Instruction{ID: "cancel-1", Action: ActionCancelUpgrade})
+	if d.pendingUpgrade != nil || d.pendingTimer != nil {
+		t.Errorf("expected the polled upgrade to be cancelled")
+	}
+	// the backend never sent polled-1 as a command, so only the cancel gets a result
+	results := backend.snapshot().results
+	if len(results) != 1 || results[0].CommandID != "cancel-1" || !results[0].Success {
+		t.Errorf("expected a single successful cancel result, got %+v", results)
+	}
+}
+
+func TestCancelCommandUpgrade(t *testing.T) {
+	backend := &commandBackend{t: t}
+	d, _ := newTestDaemon(t, backend)
+
+	upgrade := testCommand("upgrade-1", ActionUpgrade)
+	upgrade.NotBefore = time.Now().Add(time.Hour)
+	d.handleCommand(&upgrade)
+	if d.pendingUpgrade == nil || !d.pendingCommand {
+		t.Fatalf("expected the upgrade command in the pending slot, got %+v", d.pendingUpgrade)
+	}
+
+	d.handleCommand(&Instruction{ID: "cancel-1", Action: ActionCancelUpgrade})
+	d.handleCommand(&Instruction{ID: "cancel-2", Action: ActionCancelUpgrade})
+
+	results := backend.snapshot().results
+	if len(results) != 3 {
+		t.Fatalf("expected 3 command results, got %+v", results)
+	}
+	if results[0].CommandID != "upgrade-1" || results[0].Success || results[0].Error != "cancelled" {
+		t.Errorf("expected the upgrade to be reported cancelled, got %+v", results[0])
+	}
+	if results[1].CommandID != "cancel-1" || !results[1].Success {
+		t.Errorf("expected the first cancel to succeed, got %+v", results[1])
+	}
+	if results[2].CommandID != "cancel-2" || results[2].Success {
+		t.Errorf("expected cancelling without a pending upgrade to fail, got %+v", results[2])
+	}
+}
+
+func TestRestorePendingUpgrade(t *testing.T) {
+	restore := func(pending *Instruction, fromCommand bool) *daemon {
+		store := &StateStore{}
+		store.Update(func(state *AgentState) {
+			state.PendingUpgrade = pending
+			state.PendingUpgradeCommand = fromCommand
+		})
+		d := &daemon{
+			config:         getTestConfig(),
+			upgradeChecker: &DefaultUpgradeChecker{Verifier: NewInstructionVerifier()},
+			store:          store,
+		}
+		d.restoreState()
+		if d.pendingTimer != nil {
+			t.Cleanup(func() { d.pendingTimer.Stop() })
+		}
+		return d
+	}
+
+	polled := testCommand("polled-1", ActionUpgrade)
+	polled.NotBefore = time.Now().Add(time.Hour)
+	d := restore(&polled, false)
+	if d.pendingUpgrade == nil || d.pendingCommand {
+		t.Errorf("expected the polled upgrade to be restored as polled, got %+v (command %v)", d.pendingUpgrade, d.pendingCommand)
+	}
+	d.saveState()
+	if state := d.store.State(); state.PendingUpgrade == nil || state.PendingUpgradeCommand {
+		t.Errorf("expected the polled upgrade to be saved as polled, got %+v", state)
+	}
+
+	command := testCommand("upgrade-1", ActionUpgrade)
+	command.NotBefore = time.Now().Add(time.Hour)
+	if d := restore(&command, true); d.pendingUpgrade == nil || !d.pendingCommand {
+		t.Errorf("expected the upgrade command to be restored as a command, got %+v (command %v)", d.pendingUpgrade, d.pendingCommand)
+	}
+
+	expired := testCommand("expired-1", ActionUpgrade)
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if d := restore(&expired, true); d.pendingUpgrade != nil {
+		t.Errorf("expected the expired upgrade to be dropped, got %+v", d.pendingUpgrade)
+	}
+}
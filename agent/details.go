@@ -0,0 +1,278 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bluet/redt-agent/version"
+	"golang.org/x/exp/slices"
+)
+
+const packageDetailsFile = "package-details.json"
+
+// detailsTimeout bounds each changelog or advisory query; apt downloads changelogs
+const detailsTimeout = 60 * time.Second
+
+// detailsRetry is how long a failed fetch is not retried, e.g. on a host that
+// cannot reach the changelog server
+const detailsRetry = 6 * time.Hour
+
+// PackageDetails explains an update: the changelog entries since the
+// installed version and the advisories it fixes
+type PackageDetails struct {
+	Changelog  string     `json:"changelog,omitempty"`
+	Truncated  bool       `json:"truncated,omitempty"` // the changelog was cut at package_details.max_size
+	Advisories []Advisory `json:"advisories,omitempty"`
+}
+
+// Advisory is an errata entry from dnf updateinfo
+type Advisory struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"` // security, bugfix or enhancement
+	Severity string   `json:"severity,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Issued   string   `json:"issued,omitempty"`
+	CVEs     []string `json:"cves,omitempty"`
+}
+
+var (
+	// curl (7.88.1-10+deb12u5) bookworm-security; urgency=medium
+	debChangelogHeaderRegexp  = regexp.MustCompile(`^\S+ \(([^)]+)\) [^;]*;`)
+	updateInfoSeparatorRegexp = regexp.MustCompile(`(?m)^=+[ \t]*$`)
+	// "   Update ID: RHSA-2024:1234", or ": more" continuing the previous field
+	updateInfoFieldRegexp = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z ]*?)?\s*: ?(.*)$`)
+	cveRegexp             = regexp.MustCompile(`CVE-\d{4}-\d{4,}`)
+)
+
+// packageDetailsCache is kept in the state directory. Details are cached by
+// package and new version, since they never change for a given version;
+// failed fetches are remembered with the time they may be retried.
+type packageDetailsCache struct {
+	Details  map[string]PackageDetails `json:"details"`
+	Failures map[string]time.Time      `json:"failures,omitempty"` // key -> retry after
+}
+
+// enrichPackages attaches changelog excerpts and advisories to the packages
+// with an update. It runs on the daemon loop, so after one failed fetch, which
+// may have taken detailsTimeout, the remaining packages wait for the next report.
+func enrichPackages(config *Config, packages []PackageInfo) []PackageInfo {
+	pm, err := getPackageManager()
+	if err != nil {
+		log.Printf("Not fetching package details: %v\n", err)
+		return packages
+	}
+
+	cache := loadPackageDetailsCache(config.StateDir)
+	used := packageDetailsCache{Details: make(map[string]PackageDetails), Failures: make(map[string]time.Time)}
+	failed := false
+	for i := range packages {
+		pkg := &packages[i]
+		if pkg.NewVersion == "" {
+			continue
+		}
+		key := pm + " " + pkg.Name + " " + pkg.NewVersion
+		if details, ok := cache.Details[key]; ok {
+			used.Details[key] = details
+			pkg.Details = &details
+			continue
+		}
+		if retryAfter, ok := cache.Failures[key]; ok && time.Now().Before(retryAfter) {
+			used.Failures[key] = retryAfter
+			continue
+		}
+		if failed {
+			continue
+		}
+
+		details, err := fetchPackageDetails(pm, *pkg, config.PackageDetails.MaxSize)
+		if err != nil {
+			log.Printf("Error fetching details of %s, retrying after %s: %v\n", pkg.Name, detailsRetry, err)
+			used.Failures[key] = time.Now().Add(detailsRetry)
+			failed = true
+			continue
+		}
+		used.Details[key] = details
+		pkg.Details = &details
+	}
+
+	// only keep what is still pending, so the cache doesn't grow forever
+	if data, err := json.Marshal(used); err == nil {
+		if err := writeStateFile(config.StateDir, packageDetailsFile, data); err != nil {
+			log.Printf("Error caching package details: %v\n", err)
+		}
+	}
+	return packages
+}
+
+func loadPackageDetailsCache(stateDir string) packageDetailsCache {
+	var cache packageDetailsCache
+	data, err := os.ReadFile(filepath.Join(stateDir, packageDetailsFile))
+	if err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	return cache
+}
+
+func fetchPackageDetails(pm string, pkg PackageInfo, maxSize int) (PackageDetails, error) {
+	var details PackageDetails
+	switch pm {
+	case "apt-get":
+		out, err := detailsCommand("apt-get", "changelog", "-q", pkg.Name+"="+pkg.NewVersion)
+		if err != nil {
+			return details, fmt.Errorf("apt-get changelog: %v", err)
+		}
+		details.Changelog = debChangelogSince(out, pkg.Version)
+	case "dnf", "yum":
+		// the changelog command needs dnf-plugins-core or yum-plugin-changelog
+		out, err := detailsCommand(pm, "-q", "changelog", "--upgrades", pkg.Name)
+		if err == nil {
+			details.Changelog = strings.TrimSpace(out)
+		}
+		out, err = detailsCommand(pm, "-q", "updateinfo", "info", pkg.Name)
+		if err != nil {
+			return details, fmt.Errorf("%s updateinfo: %v", pm, err)
+		}
+		details.Advisories = parseUpdateInfo(out)
+	}
+	details.Changelog, details.Truncated = truncateLines(details.Changelog, maxSize)
+	return details, nil
+}
+
+func detailsCommand(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), detailsTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C", "PAGER=cat")
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// debChangelogSince returns the entries of a Debian changelog newer than
+// installed, the version being upgraded from
+func debChangelogSince(changelog, installed string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(changelog, "\n") {
+		if m := debChangelogHeaderRegexp.FindStringSubmatch(line); m != nil {
+			if installed != "" && version.CompareDeb(m[1], installed) <= 0 {
+				break
+			}
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// truncateLines cuts s to at most max bytes at a line boundary
+func truncateLines(s string, max int) (string, bool) {
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	s = s[:max]
+	if i := strings.LastIndexByte(s, '\n'); i > 0 {
+		s = s[:i]
+	}
+	return s, true
+}
+
+// parseUpdateInfo parses dnf/yum updateinfo info: one block per advisory, a
+// title between two lines of "=" followed by "Field: value" lines, with
+// values continued on lines starting with ":"
+func parseUpdateInfo(output string) []Advisory {
+	var advisories []Advisory
+	parts := updateInfoSeparatorRegexp.Split(output, -1)
+	// parts alternate: preamble, title, fields, title, fields, ...
+	for i := 1; i+1 < len(parts); i += 2 {
+		advisory := Advisory{Title: strings.TrimSpace(parts[i])}
+
+		var field string
+		for _, line := range strings.Split(parts[i+1], "\n") {
+			m := updateInfoFieldRegexp.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			if m[1] != "" {
+				field = m[1]
+			}
+			value := strings.TrimSpace(m[2])
+			switch field {
+			case "Update ID":
+				advisory.ID = value
+			case "Type":
+				advisory.Type = value
+			case "Severity":
+				advisory.Severity = value
+			case "Issued", "Updated":
+				if advisory.Issued == "" {
+					advisory.Issued = value
+				}
+			case "CVEs", "Bugs":
+				for _, cve := range cveRegexp.FindAllString(value, -1) {
+					if !slices.Contains(advisory.CVEs, cve) {
+						advisory.CVEs = append(advisory.CVEs, cve)
+					}
+				}
+			}
+		}
+		if advisory.ID != "" {
+			advisories = append(advisories, advisory)
+		}
+	}
+	return advisories
+}
+
+// RunShowDetails prints the changelog and advisories of every pending update
+func RunShowDetails() error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+
+	packages, err := getPackageInfo()
+	if err != nil {
+		return fmt.Errorf("Error checking for upgradable packages: %v", err)
+	}
+	packages = matchVulnerabilities(&config.Vulnerabilities, packages)
+	packages = enrichPackages(config, packages)
+
+	for _, pkg := range packages {
+		if pkg.Details == nil {
+			continue
+		}
+		fmt.Printf("\n%s %s -> %s", pkg.Name, pkg.Version, pkg.NewVersion)
+		if pkg.UpdateType != "" {
+			fmt.Printf(" (%s)", pkg.UpdateType)
+		}
+		fmt.Println()
+		for _, cve := range pkg.CVEs {
+			if cve.Fixed {
+				fmt.Printf("  Fixes %s (%s)\n", cve.ID, cve.Severity)
+			}
+		}
+		for _, advisory := range pkg.Details.Advisories {
+			fmt.Printf("  %s [%s", advisory.ID, advisory.Type)
+			if advisory.Severity != "" {
+				fmt.Printf(", %s", advisory.Severity)
+			}
+			fmt.Printf("] %s\n", advisory.Title)
+			if len(advisory.CVEs) > 0 {
+				fmt.Printf("    %s\n", strings.Join(advisory.CVEs, " "))
+			}
+		}
+		if pkg.Details.Changelog != "" {
+			fmt.Println("    " + strings.ReplaceAll(pkg.Details.Changelog, "\n", "\n    "))
+			if pkg.Details.Truncated {
+				fmt.Println("    ...")
+			}
+		}
+	}
+	return nil
+}
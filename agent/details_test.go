@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestDebChangelogSince(t *testing.T) {
+	changelog := debChangelogSince(readTestdata(t, "apt-changelog-curl.txt"), "7.88.1-10+deb12u3")
+	if !strings.Contains(changelog, "CVE-2023-46218") || !strings.Contains(changelog, "CVE-2023-38545") {
+		t.Errorf("expected the entries since the installed version, got %q", changelog)
+	}
+	if strings.Contains(changelog, "CVE-2023-28320") || strings.Contains(changelog, "(7.88.1-10+deb12u3)") {
+		t.Errorf("expected no entries of the installed version, got %q", changelog)
+	}
+
+	truncated, cut := truncateLines(changelog, 100)
+	if !cut || len(truncated) > 100 || strings.HasSuffix(truncated, "PSL") {
+		t.Errorf("expected a cut at a line boundary, got %q", truncated)
+	}
+	if _, cut := truncateLines(changelog, 0); cut {
+		t.Errorf("expected no limit with a zero size")
+	}
+}
+
+func TestParseUpdateInfo(t *testing.T) {
+	advisories := parseUpdateInfo(readTestdata(t, "dnf-updateinfo-curl-el9.txt"))
+	if len(advisories) != 2 {
+		t.Fatalf("expected 2 advisories, got %+v", advisories)
+	}
+
+	security := advisories[0]
+	if security.ID != "RHSA-2024:1601" || security.Type != "security" || security.Severity != "Moderate" || security.Title != "Moderate: curl security update" {
+		t.Errorf("unexpected advisory: %+v", security)
+	}
+	if len(security.CVEs) != 1 || security.CVEs[0] != "CVE-2024-2398" || security.Issued != "2024-04-01 00:00:00" {
+		t.Errorf("unexpected advisory: %+v", security)
+	}
+	if advisories[1].ID != "RHBA-2024:0923" || advisories[1].Type != "bugfix" || len(advisories[1].CVEs) != 0 {
+		t.Errorf("unexpected advisory: %+v", advisories[1])
+	}
+}
+
+func TestEnrichPackagesCachesFailures(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	// changelogs are only available for curl; anything else fails like an unreachable server
+	script := `#!/bin/sh
+echo "$3" >> ` + calls + `
+case "$3" in
+curl=*) printf 'curl (7.88.1-10+deb12u5) bookworm-security; urgency=medium\n\n  * Fix CVE-2024-2398\n' ;;
+*) exit 100 ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "apt-get"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	config := &Config{StateDir: t.TempDir()}
+	packages := []PackageInfo{
+		{Name: "unreachable", Version: "1.0", NewVersion: "1.1"},
+		{Name: "curl", Version: "7.88.1-10+deb12u4", NewVersion: "7.88.1-10+deb12u5"},
+	}
+	fetched := func() []string {
+		data, _ := os.ReadFile(calls)
+		return strings.Fields(string(data))
+	}
+
+	// after a failure the remaining packages wait for the next report
+	enriched := enrichPackages(config, slices.Clone(packages))
+	if got := fetched(); len(got) != 1 || enriched[0].Details != nil || enriched[1].Details != nil {
+		t.Errorf("expected a single failed fetch, got fetches %v", got)
+	}
+
+	// the failure is not retried before detailsRetry
+	enriched = enrichPackages(config, slices.Clone(packages))
+	if got := fetched(); len(got) != 2 || got[1] != "curl=7.88.1-10+deb12u5" {
+		t.Errorf("expected only curl to be fetched, got fetches %v", got)
+	}
+	if enriched[1].Details == nil || !strings.Contains(enriched[1].Details.Changelog, "CVE-2024-2398") {
+		t.Errorf("expected curl's changelog, got %+v", enriched[1].Details)
+	}
+
+	enriched = enrichPackages(config, slices.Clone(packages))
+	if got := fetched(); len(got) != 2 || enriched[1].Details == nil {
+		t.Errorf("expected cached details and failures, got fetches %v", got)
+	}
+
+	cache := loadPackageDetailsCache(config.StateDir)
+	if retryAfter := cache.Failures["apt-get unreachable 1.1"]; time.Until(retryAfter) < detailsRetry-time.Minute {
+		t.Errorf("expected the failure to be retried after %s, got %v", detailsRetry, retryAfter)
+	}
+}
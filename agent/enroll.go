@@ -0,0 +1,260 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/host"
+)
+
+const (
+	credentialsFile = "credentials.json"
+
+	// rotateCredentialHeader is set by the backend on any response when the
+	// agent should exchange its credential for a new one
+	rotateCredentialHeader = "X-Redt-Rotate-Credential"
+)
+
+// credentialMu guards Config.Token and Config.AgentID, which change on rotation
+// while the daemon and the command channel are both talking to the backend
+var credentialMu sync.RWMutex
+
+// HostIdentity is sent to the backend when enrolling
+type HostIdentity struct {
+	Hostname  string `json:"hostname"`
+	MachineID string `json:"machine_id,omitempty"`
+	HostID    string `json:"host_id,omitempty"`
+	OSInfo    string `json:"os_info"`
+	Arch      string `json:"arch"`
+}
+
+// Credentials is the per-host credential issued by the backend
+type Credentials struct {
+	AgentID    string    `json:"agent_id"`
+	Credential string    `json:"credential"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+	RotatedAt  time.Time `json:"rotated_at,omitempty"`
+}
+
+type enrollRequest struct {
+	EnrollmentKey string       `json:"enrollment_key"`
+	Host          HostIdentity `json:"host"`
+}
+
+type credentialResponse struct {
+	AgentID    string `json:"agent_id"`
+	Credential string `json:"credential"`
+}
+
+func RunEnroll(enrollmentKey string, force bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+	if config.BackendURL == "" {
+		return fmt.Errorf("backend_url is not configured")
+	}
+	if enrollmentKey == "" {
+		return fmt.Errorf("an enrollment key is required")
+	}
+
+	existing, err := loadCredentials(config.StateDir)
+	if err != nil {
+		return err
+	}
+	if existing != nil && !force {
+		return fmt.Errorf("this host is already enrolled as %s (use --force to enroll again)", existing.AgentID)
+	}
+
+	identity, err := collectHostIdentity(config)
+	if err != nil {
+		return err
+	}
+
+	resp, err := postJSON(config, config.EnrollEndpoint, enrollRequest{
+		EnrollmentKey: enrollmentKey,
+		Host:          identity,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enroll: %v", err)
+	}
+	defer resp.Body.Close()
+
+	creds, err := decodeCredentialResponse(resp)
+	if err != nil {
+		return fmt.Errorf("failed to enroll: %v", err)
+	}
+	creds.EnrolledAt = time.Now().UTC()
+
+	if err := saveCredentials(config.StateDir, creds); err != nil {
+		return err
+	}
+
+	fmt.Printf("Enrolled %s as agent %s\n", identity.Hostname, creds.AgentID)
+	return nil
+}
+
+func collectHostIdentity(config *Config) (HostIdentity, error) {
+	identity := HostIdentity{
+		Hostname: config.Hostname,
+		Arch:     runtime.GOARCH,
+	}
+
+	if identity.Hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return identity, fmt.Errorf("failed to determine hostname: %v", err)
+		}
+		identity.Hostname = hostname
+	}
+
+	if machineID, err := os.ReadFile("/etc/machine-id"); err == nil {
+		identity.MachineID = strings.TrimSpace(string(machineID))
+	}
+
+	hostInfo, err := host.Info()
+	if err != nil {
+		return identity, fmt.Errorf("failed to collect OS info: %v", err)
+	}
+	identity.HostID = hostInfo.HostID
+	identity.OSInfo = fmt.Sprintf("%s %s %s", hostInfo.OS, hostInfo.Platform, hostInfo.PlatformVersion)
+
+	return identity, nil
+}
+
+// rotateCredential exchanges the current credential for a new one and stores it
+func rotateCredential(config *Config) error {
+	credentialMu.Lock()
+	defer credentialMu.Unlock()
+
+	creds, err := loadCredentials(config.StateDir)
+	if err != nil {
+		return err
+	}
+	if creds == nil {
+		return fmt.Errorf("backend requested credential rotation but this host is not enrolled")
+	}
+
+	body, err := json.Marshal(map[string]string{"agent_id": creds.AgentID})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", config.RotateCredentialEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+creds.Credential)
+
+	// not doBackendRequest, so a rotation response can never trigger another rotation
+	resp, err := backendClient(config).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to rotate credential: %v", describeTLSError(err))
+	}
+	defer resp.Body.Close()
+
+	rotated, err := decodeCredentialResponse(resp)
+	if err != nil {
+		return fmt.Errorf("failed to rotate credential: %v", err)
+	}
+	rotated.EnrolledAt = creds.EnrolledAt
+	rotated.RotatedAt = time.Now().UTC()
+
+	if err := saveCredentials(config.StateDir, rotated); err != nil {
+		return err
+	}
+
+	config.AgentID = rotated.AgentID
+	config.Token = rotated.Credential
+	log.Printf("Rotated credential for agent %s\n", rotated.AgentID)
+	return nil
+}
+
+func decodeCredentialResponse(resp *http.Response) (*Credentials, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+
+	var body credentialResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	if body.AgentID == "" || body.Credential == "" {
+		return nil, fmt.Errorf("response is missing agent_id or credential")
+	}
+
+	return &Credentials{AgentID: body.AgentID, Credential: body.Credential}, nil
+}
+
+// loadCredentials returns nil without error when the host has not been enrolled
+func loadCredentials(stateDir string) (*Credentials, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, credentialsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %v", err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %v", err)
+	}
+	return &creds, nil
+}
+
+func saveCredentials(stateDir string, creds *Credentials) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeStateFile(stateDir, credentialsFile, data); err != nil {
+		return fmt.Errorf("failed to save credentials: %v", err)
+	}
+	return nil
+}
+
+// writeStateFile atomically replaces name in stateDir with a file only readable by its owner
+func writeStateFile(stateDir, name string, data []byte) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(stateDir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(stateDir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(stateDir, name))
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfigFile writes config.yml to a new working directory, where LoadConfig finds it
+func writeTestConfigFile(t *testing.T, content string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+}
+
+func TestRunEnroll(t *testing.T) {
+	enrollments := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/enroll" || r.Method != "POST" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		var req enrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid enroll request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.EnrollmentKey != "enroll-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.Host.Hostname != "FunkyPenguin" || req.Host.Arch == "" {
+			t.Errorf("unexpected host identity %+v", req.Host)
+		}
+		enrollments++
+		json.NewEncoder(w).Encode(credentialResponse{
+			AgentID:    fmt.Sprintf("agent-%d", enrollments),
+			Credential: fmt.Sprintf("credential-%d", enrollments),
+		})
+	}))
+	defer server.Close()
+
+	stateDir := filepath.Join(t.TempDir(), "state")
+	writeTestConfigFile(t, fmt.Sprintf("backend_url: %q\nstate_dir: %q\nhostname: FunkyPenguin\n", server.URL, stateDir))
+
+	if err := RunEnroll("wrong-key", false); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("expected a rejected enrollment, got %v", err)
+	}
+	if err := RunEnroll("enroll-key", false); err != nil {
+		t.Fatalf("RunEnroll() error = %v", err)
+	}
+
+	creds, err := loadCredentials(stateDir)
+	if err != nil || creds == nil {
+		t.Fatalf("loadCredentials() = %v, %v", creds, err)
+	}
+	if creds.AgentID != "agent-1" || creds.Credential != "credential-1" || creds.EnrolledAt.IsZero() {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+	if info, err := os.Stat(stateDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("expected state_dir with mode 0700, got %v (%v)", info.Mode().Perm(), err)
+	}
+	if info, err := os.Stat(filepath.Join(stateDir, credentialsFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected credentials with mode 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+
+	// the enrolled credential replaces the configured token
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AgentID != "agent-1" || config.Token != "credential-1" {
+		t.Errorf("expected the enrolled credential to be used, got agent %q token %q", config.AgentID, config.Token)
+	}
+	if logged := fmt.Sprintf("%v", config.redacted()); strings.Contains(logged, "credential-1") {
+		t.Errorf("redacted configuration still contains the credential: %s", logged)
+	}
+
+	if err := RunEnroll("enroll-key", false); err == nil || !strings.Contains(err.Error(), "already enrolled") {
+		t.Errorf("expected enrolling again to be refused, got %v", err)
+	}
+	if err := RunEnroll("enroll-key", true); err != nil {
+		t.Fatalf("RunEnroll(force) error = %v", err)
+	}
+	if creds, _ := loadCredentials(stateDir); creds == nil || creds.AgentID != "agent-2" {
+		t.Errorf("expected a forced enrollment to replace the credentials, got %+v", creds)
+	}
+}
+
+func TestRotateCredential(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/credentials/rotate":
+			if got := r.Header.Get("Authorization"); got != "Bearer old-credential" {
+				t.Errorf("rotation authenticated with %q", got)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			// a rotation response asking for another rotation must not loop
+			w.Header().Set(rotateCredentialHeader, "true")
+			json.NewEncoder(w).Encode(credentialResponse{AgentID: "agent-1", Credential: "new-credential"})
+		case "/telemetry":
+			w.Header().Set(rotateCredentialHeader, "true")
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	enrolledAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	config := &Config{
+		BackendURL:               server.URL,
+		TelemetryEndpoint:        server.URL + "/telemetry",
+		RotateCredentialEndpoint: server.URL + "/credentials/rotate",
+		StateDir:                 t.TempDir(),
+		AgentID:                  "agent-1",
+		Token:                    "old-credential",
+	}
+	if err := saveCredentials(config.StateDir, &Credentials{AgentID: "agent-1", Credential: "old-credential", EnrolledAt: enrolledAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	// any backend response can request the rotation
+	resp, err := postJSON(config, config.TelemetryEndpoint, TelemetryData{})
+	if err != nil {
+		t.Fatalf("postJSON() error = %v", err)
+	}
+	resp.Body.Close()
+
+	if config.Token != "new-credential" {
+		t.Errorf("expected the rotated credential to be used, got %q", config.Token)
+	}
+	creds, err := loadCredentials(config.StateDir)
+	if err != nil || creds == nil {
+		t.Fatalf("loadCredentials() = %v, %v", creds, err)
+	}
+	if creds.Credential != "new-credential" || !creds.EnrolledAt.Equal(enrolledAt) || creds.RotatedAt.IsZero() {
+		t.Errorf("unexpected credentials after rotation %+v", creds)
+	}
+	if info, err := os.Stat(filepath.Join(config.StateDir, credentialsFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected credentials with mode 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestRotateCredentialNotEnrolled(t *testing.T) {
+	config := &Config{StateDir: t.TempDir(), RotateCredentialEndpoint: "http://127.0.0.1:1/credentials/rotate"}
+	if err := rotateCredential(config); err == nil || !strings.Contains(err.Error(), "not enrolled") {
+		t.Errorf("expected rotation without credentials to fail, got %v", err)
+	}
+}
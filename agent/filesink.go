@@ -0,0 +1,239 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileSink writes telemetry, package and upgrade-result records as JSON lines
+// into a rotating local file, for hosts that cannot reach the backend.
+type FileSink struct {
+	mu     sync.Mutex
+	writer *rotatingWriter
+}
+
+// sinkRecord is a single line in the sink file
+type sinkRecord struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Hostname  string      `json:"hostname,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+func NewFileSink(config FileSinkConfig) (*FileSink, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("file sink path is not configured")
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create file sink directory: %v", err)
+	}
+
+	writer := &rotatingWriter{
+		path:       config.Path,
+		maxSize:    config.MaxSize,
+		maxAge:     config.MaxAge,
+		maxBackups: config.MaxBackups,
+		compress:   config.Compress,
+	}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+
+	return &FileSink{writer: writer}, nil
+}
+
+func (s *FileSink) SendTelemetryData(config *Config, data TelemetryData) error {
+	return s.write(config, "telemetry", data)
+}
+
+func (s *FileSink) ReportPackageInfo(config *Config, packages []PackageInfo) error {
+	return s.write(config, "packages", packages)
+}
+
+func (s *FileSink) ReportRepositories(config *Config, repos []Repository) error {
+	return s.write(config, "repositories", repos)
+}
+
+func (s *FileSink) ReportUpgradeResult(config *Config, result UpgradeResult) error {
+	return s.write(config, "upgrade_result", result)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.close()
+}
+
+func (s *FileSink) write(config *Config, recordType string, data interface{}) error {
+	line, err := json.Marshal(sinkRecord{
+		Type:      recordType,
+		Timestamp: time.Now().UTC(),
+		Hostname:  config.Hostname,
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s record: %v", recordType, err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to write %s record: %v", recordType, err)
+	}
+	return nil
+}
+
+// rotatingWriter appends to a file and rotates it once it grows past maxSize
+// or has been in use for longer than maxAge. Rotated files are renamed with a
+// timestamp suffix, optionally gzipped, and pruned down to maxBackups.
+type rotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open file sink: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat file sink: %v", err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	w.openedAt = time.Now()
+	if w.size > 0 {
+		// an existing file is treated as having been started when it was last written
+		w.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		return 0, fmt.Errorf("file sink is closed")
+	}
+
+	if w.size > 0 && w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) shouldRotate(next int64) bool {
+	if w.maxSize > 0 && w.size+next > w.maxSize {
+		return true
+	}
+	return w.maxAge > 0 && time.Since(w.openedAt) >= w.maxAge
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	// reopened even if the rotation failed, so that the sink isn't left closed
+	if err := w.rotateClosed(); err != nil {
+		log.Printf("Error rotating file sink: %v\n", err)
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) rotateClosed() error {
+	rotated := fmt.Sprintf("%s.%s", w.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(w.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate file sink: %v", err)
+	}
+
+	if w.compress {
+		if err := gzipFile(rotated); err != nil {
+			return err
+		}
+	}
+
+	return w.prune()
+}
+
+func (w *rotatingWriter) prune() error {
+	if w.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return fmt.Errorf("failed to list rotated files: %v", err)
+	}
+	if len(backups) <= w.maxBackups {
+		return nil
+	}
+
+	// the timestamp suffix sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-w.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			return fmt.Errorf("failed to remove rotated file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (w *rotatingWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open rotated file: %v", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed file: %v", err)
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to compress rotated file: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return fmt.Errorf("failed to compress rotated file: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to compress rotated file: %v", err)
+	}
+
+	return os.Remove(path)
+}
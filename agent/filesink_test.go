@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+	sink, err := NewFileSink(FileSinkConfig{
+		Path:       path,
+		MaxSize:    256,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	testConfig := getTestConfig()
+	testConfig.Hostname = "FunkyPenguin"
+	for i := 0; i < 20; i++ {
+		if err := sink.SendTelemetryData(testConfig, TelemetryData{OSInfo: "linux ubuntu 22.04"}); err != nil {
+			t.Fatalf("SendTelemetryData() error = %v", err)
+		}
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 retained backups, got %d: %v", len(backups), backups)
+	}
+	for _, backup := range backups {
+		if filepath.Ext(backup) != ".gz" {
+			t.Errorf("expected %s to be gzipped", backup)
+		}
+	}
+
+	file, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("rotated file is not valid gzip: %v", err)
+	}
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var record sinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		if record.Type != "telemetry" || record.Hostname != "FunkyPenguin" {
+			t.Errorf("unexpected record %+v", record)
+		}
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+	// a non-empty directory matching the backup pattern cannot be pruned
+	if err := os.MkdirAll(filepath.Join(path+".00000000", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewFileSink(FileSinkConfig{
+		Path:       path,
+		MaxSize:    256,
+		MaxBackups: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink() error = %v", err)
+	}
+	defer sink.Close()
+
+	testConfig := getTestConfig()
+	for i := 0; i < 10; i++ {
+		if err := sink.SendTelemetryData(testConfig, TelemetryData{OSInfo: "linux ubuntu 22.04"}); err != nil {
+			t.Fatalf("SendTelemetryData() error = %v, the sink should stay open after a failed rotation", err)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		t.Errorf("expected records to be written after the failed rotation: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Conffile policies for unattended apt upgrades
+const (
+	ConffilesKeep = "keep" // keep locally modified configuration files
+	ConffilesNew  = "new"  // install the package maintainer's version
+)
+
+// Upgrade policies, which packages unattended upgrades upgrade
+const (
+	UpgradePolicyAll          = "all"
+	UpgradePolicyCriticalCVEs = "critical_cves" // only packages whose update fixes a critical CVE
+)
+
+// Operations the root helper performs, using the helper's own configuration
+const (
+	HelperOpUpgrade         = "upgrade"          // an unattended upgrade
+	HelperOpEnforcePackages = "enforce_packages" // install and remove packages to match the desired state
+	HelperOpFindServices    = "find_services"    // list the services using deleted files, as JSON
+)
+
+const maxHelperOutput = 1024 * 1024
+
+type helperRequest struct {
+	Op string `json:"op"`
+}
+
+type helperResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+// performUnattendedUpgrade upgrades the system without ever waiting for
+// input, for the daemon. An unprivileged daemon delegates to the root helper
+// when one is configured, and otherwise uses non-interactive sudo.
+func performUnattendedUpgrade(config *Config) error {
+	if os.Geteuid() != 0 && config.Upgrades.HelperSocket != "" {
+		output, err := callHelper(config.Upgrades.HelperSocket, HelperOpUpgrade)
+		if output != "" {
+			log.Printf("Upgrade output from helper:\n%s", output)
+		}
+		return err
+	}
+	return runUnattendedUpgrade(config, os.Stdout)
+}
+
+// runUnattendedUpgrade runs the package manager with no terminal, answering
+// yes to the transaction and resolving configuration file prompts by policy
+func runUnattendedUpgrade(config *Config, output io.Writer) error {
+	pm, err := getPackageManager()
+	if err != nil {
+		return err
+	}
+
+	packages, err := selectUpgrades(config)
+	if err != nil {
+		return err
+	}
+	if packages != nil && len(packages) == 0 {
+		log.Printf("No upgrades selected by the %s policy\n", config.Upgrades.Policy)
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	switch pm {
+	case "apt-get":
+		conffileOption := "--force-confold"
+		if config.Upgrades.Conffiles == ConffilesNew {
+			conffileOption = "--force-confnew"
+		}
+		args := []string{"-y", "-q",
+			"-o", "Dpkg::Options::=--force-confdef",
+			"-o", "Dpkg::Options::=" + conffileOption,
+		}
+		if packages == nil {
+			args = append(args, "upgrade")
+		} else {
+			args = append(append(args, "install", "--only-upgrade"), packages...)
+		}
+		cmd = privilegedCommand("apt-get", args...)
+		cmd.Env = append(os.Environ(),
+			"DEBIAN_FRONTEND=noninteractive",
+			// only list services to restart; the agent's own check reports and restarts them
+			"NEEDRESTART_MODE=l",
+		)
+	case "dnf", "yum":
+		// rpm never prompts about configuration files, it writes .rpmnew files instead
+		cmd = privilegedCommand(pm, append([]string{"-y", "upgrade"}, packages...)...)
+	default:
+		return errors.New("unsupported package manager")
+	}
+
+	cmd.Stdin = nil
+	cmd.Stdout = output
+	cmd.Stderr = output
+	log.Printf("Running %s\n", strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unattended upgrade failed: %v", err)
+	}
+	return nil
+}
+
+// selectUpgrades returns the packages the upgrade policy allows to upgrade,
+// or nil to upgrade everything
+func selectUpgrades(config *Config) ([]string, error) {
+	if config.Upgrades.Policy != UpgradePolicyCriticalCVEs {
+		return nil, nil
+	}
+
+	packages, err := getPackageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upgradable packages: %v", err)
+	}
+	return criticalUpgrades(matchVulnerabilities(&config.Vulnerabilities, packages)), nil
+}
+
+// criticalUpgrades returns the packages whose update fixes a critical CVE
+func criticalUpgrades(packages []PackageInfo) []string {
+	selected := []string{}
+	for _, pkg := range packages {
+		if pkg.NewVersion != "" && fixesSeverity(pkg, SeverityCritical) {
+			selected = append(selected, pkg.Name)
+		}
+	}
+	return selected
+}
+
+// callHelper asks the root helper to perform op and returns its output
+func callHelper(socket, op string) (string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to helper: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(helperRequest{Op: op}); err != nil {
+		return "", fmt.Errorf("failed to send request to helper: %v", err)
+	}
+	var resp helperResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", fmt.Errorf("failed to read response from helper: %v", err)
+	}
+	if !resp.Success {
+		return resp.Output, fmt.Errorf("helper: %s", resp.Error)
+	}
+	return resp.Output, nil
+}
+
+// RunHelper serves the daemon's privileged operations as root over a Unix
+// socket, so that the daemon itself can run unprivileged without sudo.
+// Only the users in upgrades.helper_users (and root) may connect, and they
+// can only choose among fixed operations, not pass commands or arguments.
+func RunHelper() error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("the helper must run as root")
+	}
+	socket := config.Upgrades.HelperSocket
+	if socket == "" {
+		return errors.New("upgrades.helper_socket is not configured")
+	}
+
+	allowed := []uint32{0}
+	for _, name := range config.Upgrades.HelperUsers {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return fmt.Errorf("invalid helper user %q: %v", name, err)
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		allowed = append(allowed, uint32(uid))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return err
+	}
+	// a socket left behind by a previous run
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socket, err)
+	}
+	defer listener.Close()
+	// access is checked per connection with the peer's credentials
+	if err := os.Chmod(socket, 0666); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	log.Printf("Helper listening on %s\n", socket)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// one operation at a time; upgrades must not run concurrently
+		serveHelperConn(config, conn.(*net.UnixConn), allowed)
+	}
+}
+
+func serveHelperConn(config *Config, conn *net.UnixConn, allowed []uint32) {
+	defer conn.Close()
+
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Printf("Rejected helper connection: %v\n", err)
+		return
+	}
+	if !slices.Contains(allowed, uid) {
+		log.Printf("Rejected helper connection from uid %d\n", uid)
+		json.NewEncoder(conn).Encode(helperResponse{Error: "permission denied"})
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var req helperRequest
+	if err := json.NewDecoder(io.LimitReader(conn, 4096)).Decode(&req); err != nil {
+		log.Printf("Malformed helper request from uid %d: %v\n", uid, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	log.Printf("Helper request from uid %d: %s\n", uid, req.Op)
+	var resp helperResponse
+	switch req.Op {
+	case HelperOpUpgrade:
+		var output limitedBuffer
+		output.limit = maxHelperOutput
+		err = runUnattendedUpgrade(config, io.MultiWriter(os.Stdout, &output))
+		resp.Output = output.String()
+	case HelperOpEnforcePackages:
+		err = applyDesiredState(&config.Packages)
+	case HelperOpFindServices:
+		var output []byte
+		output, err = json.Marshal(findServicesNeedingRestart("/proc"))
+		resp.Output = string(output)
+	default:
+		err = fmt.Errorf("unsupported operation %q", req.Op)
+	}
+	resp.Success = err == nil
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("Error responding to helper request: %v\n", err)
+	}
+}
+
+// peerUID returns the user ID of the process on the other end of conn
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHelperAccessControl(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	serve := func(allowed []uint32) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serveHelperConn(&Config{}, conn.(*net.UnixConn), allowed)
+	}
+
+	go serve(nil)
+	if _, err := callHelper(socket, HelperOpUpgrade); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected permission denied for a user not allowed, got %v", err)
+	}
+
+	go serve([]uint32{uint32(os.Getuid())})
+	if _, err := callHelper(socket, "rm -rf /"); err == nil || !strings.Contains(err.Error(), "unsupported operation") {
+		t.Errorf("Expected unsupported operation to be rejected, got %v", err)
+	}
+
+	go serve([]uint32{uint32(os.Getuid())})
+	output, err := callHelper(socket, HelperOpFindServices)
+	var services []ServiceRestart
+	if err != nil || json.Unmarshal([]byte(output), &services) != nil {
+		t.Errorf("Expected the service scan as JSON, got %q, %v", output, err)
+	}
+}
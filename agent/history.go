@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyFile = "history.jsonl"
+
+// maxHistoryLine bounds a single history entry, which includes hook output
+const maxHistoryLine = 4 * 1024 * 1024
+
+// maxHistorySize is the size at which history.jsonl is rotated to
+// history.jsonl.1, replacing the previous one, so the history keeps between
+// one and two files' worth of runs
+const maxHistorySize = 16 * 1024 * 1024
+
+// finishUpgradeResult completes result with the outcome of the run, appends
+// it to the local history and keeps the record for a later rollback
+func finishUpgradeResult(config *Config, result *UpgradeResult, err error) {
+	result.FinishedAt = time.Now()
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	appendHistory(config, *result)
+	saveUpgradeRecord(config, *result)
+}
+
+// appendHistory adds a run to state_dir/history.jsonl, one JSON object per line
+func appendHistory(config *Config, result UpgradeResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error encoding upgrade history: %v\n", err)
+		return
+	}
+
+	if err := os.MkdirAll(config.StateDir, 0700); err != nil {
+		log.Printf("Error recording upgrade history: %v\n", err)
+		return
+	}
+	path := filepath.Join(config.StateDir, historyFile)
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(data)) > maxHistorySize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			log.Printf("Error rotating upgrade history: %v\n", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Error recording upgrade history: %v\n", err)
+		return
+	}
+	defer f.Close()
+	// start a new line if a previous write was cut short
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Error recording upgrade history: %v\n", err)
+	}
+}
+
+// readHistory returns the runs started at or after since, oldest first
+func readHistory(stateDir string, since time.Time) ([]UpgradeResult, error) {
+	path := filepath.Join(stateDir, historyFile)
+	// the rotated file holds the older runs
+	rotated, err := readHistoryFile(path+".1", since)
+	if err != nil {
+		return nil, err
+	}
+	results, err := readHistoryFile(path, since)
+	if err != nil {
+		return nil, err
+	}
+	return append(rotated, results...), nil
+}
+
+func readHistoryFile(path string, since time.Time) ([]UpgradeResult, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade history: %v", err)
+	}
+	defer f.Close()
+
+	var results []UpgradeResult
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxHistoryLine)
+	for line := 1; scanner.Scan(); line++ {
+		var result UpgradeResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			// e.g. a line cut short by a crash; the rest is still usable
+			log.Printf("Skipping malformed upgrade history line %d of %s: %v\n", line, path, err)
+			continue
+		}
+		if result.StartedAt.Before(since) {
+			continue
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read upgrade history: %v", err)
+	}
+	return results, nil
+}
+
+// parseSince accepts a date (2006-01-02), an RFC 3339 time, or an age like
+// 36h or 7d
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, expected a date, an RFC 3339 time or an age like 36h or 7d", s)
+}
+
+// RunHistory lists past upgrade runs, or shows a single one in detail
+func RunHistory(since string, asJSON bool, id string) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+
+	sinceTime, err := parseSince(since, time.Now())
+	if err != nil {
+		return err
+	}
+	results, err := readHistory(config.StateDir, sinceTime)
+	if err != nil {
+		return err
+	}
+
+	if id != "" {
+		for _, result := range results {
+			if result.ID == id {
+				if asJSON {
+					return printJSON(result)
+				}
+				printUpgradeResult(result)
+				return nil
+			}
+		}
+		return fmt.Errorf("no upgrade %s in the history", id)
+	}
+
+	if asJSON {
+		if results == nil {
+			results = []UpgradeResult{}
+		}
+		return printJSON(results)
+	}
+	if len(results) == 0 {
+		fmt.Println("No upgrades recorded.")
+		return nil
+	}
+	fmt.Printf("%-32s  %-20s  %-8s  %-9s  %-8s  %s\n", "ID", "STARTED", "TRIGGER", "RESULT", "DURATION", "PACKAGES")
+	for _, result := range results {
+		fmt.Printf("%-32s  %-20s  %-8s  %-9s  %-8s  %d\n",
+			result.ID,
+			result.StartedAt.Local().Format("2006-01-02 15:04:05"),
+			result.Trigger,
+			resultStatus(result),
+			result.FinishedAt.Sub(result.StartedAt).Round(time.Second),
+			len(result.Changes))
+	}
+	return nil
+}
+
+func resultStatus(result UpgradeResult) string {
+	switch {
+	case result.DryRun:
+		return "dry-run"
+	case result.RollbackOf != "" && result.Success:
+		return "rollback"
+	case result.Operation != "" && result.Success:
+		return result.Operation
+	case result.Success:
+		return "ok"
+	default:
+		return "failed"
+	}
+}
+
+func printUpgradeResult(result UpgradeResult) {
+	fmt.Printf("Upgrade %s\n", result.ID)
+	fmt.Printf("- Trigger: %s\n", result.Trigger)
+	if result.Operation != "" {
+		fmt.Printf("- Operation: %s\n", result.Operation)
+	}
+	if result.InstructionID != "" {
+		fmt.Printf("- Instruction: %s\n", result.InstructionID)
+	}
+	if result.RollbackOf != "" {
+		fmt.Printf("- Rollback of: %s\n", result.RollbackOf)
+	}
+	fmt.Printf("- Started: %s\n", result.StartedAt.Local().Format(time.RFC3339))
+	fmt.Printf("- Duration: %s\n", result.FinishedAt.Sub(result.StartedAt).Round(time.Second))
+	fmt.Printf("- Result: %s\n", resultStatus(result))
+	if result.Error != "" {
+		fmt.Printf("- Error: %s\n", result.Error)
+	}
+	if result.Snapshot != nil {
+		fmt.Printf("- Snapshot: %s (%s)\n", result.Snapshot.Name, result.Snapshot.Kind)
+	}
+
+	if len(result.Changes) > 0 {
+		fmt.Printf("- %d package(s) changed\n", len(result.Changes))
+		for _, change := range result.Changes {
+			fmt.Printf("  - %s (%s): %s -> %s\n", change.Name, change.Arch, change.OldVersion, change.NewVersion)
+		}
+	}
+	for _, failure := range result.NotReverted {
+		fmt.Printf("- Not reverted: %s (%s) to %s: %s\n", failure.Name, failure.Arch, failure.Version, failure.Reason)
+	}
+	if result.Plan != nil && result.DryRun {
+		printUpgradePlan(result.Plan)
+	}
+
+	for _, hook := range result.Hooks {
+		status := "ok"
+		if hook.Error != "" {
+			status = hook.Error
+		}
+		fmt.Printf("- %s hook %q: %s (%s)\n", hook.Phase, hook.Command, status, hook.Duration.Round(time.Millisecond))
+		if output := strings.TrimSpace(hook.Output); output != "" {
+			fmt.Println("    " + strings.ReplaceAll(output, "\n", "\n    "))
+		}
+	}
+
+	for _, service := range result.Services {
+		state := "needs restart"
+		if service.Restarted {
+			state = "restarted"
+		}
+		fmt.Printf("- Service %s: %s\n", service.Unit, state)
+	}
+	if result.Reboot != nil && result.Reboot.Required {
+		fmt.Printf("- Reboot required: %s\n", strings.Join(result.Reboot.Reasons, "; "))
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	config := &Config{StateDir: t.TempDir()}
+	started := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+
+	first := UpgradeResult{ID: "aa01", Trigger: "cli", StartedAt: started}
+	finishUpgradeResult(config, &first, nil)
+	second := UpgradeResult{
+		ID:            "bb02",
+		Trigger:       "backend",
+		InstructionID: "instr-1",
+		StartedAt:     started.Add(48 * time.Hour),
+		Hooks:         []HookResult{{Phase: HookPostUpgrade, Command: "true", Output: "done\n"}},
+	}
+	finishUpgradeResult(config, &second, os.ErrPermission)
+
+	// a line cut short by a crash must not hide the other runs
+	f, err := os.OpenFile(filepath.Join(config.StateDir, historyFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"cc`)
+	f.Close()
+	third := UpgradeResult{ID: "dd04", Trigger: "remediation", StartedAt: started.Add(72 * time.Hour)}
+	finishUpgradeResult(config, &third, nil)
+
+	results, err := readHistory(config.StateDir, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if len(results) != 3 || results[0].ID != "aa01" || results[1].ID != "bb02" || results[2].ID != "dd04" {
+		t.Fatalf("Unexpected history: %+v", results)
+	}
+	if !results[0].Success || results[1].Success || results[1].Error == "" {
+		t.Errorf("Outcome not recorded: %+v", results)
+	}
+	if results[1].InstructionID != "instr-1" || len(results[1].Hooks) != 1 || results[1].Hooks[0].Output != "done\n" {
+		t.Errorf("Instruction or hook output not recorded: %+v", results[1])
+	}
+
+	results, err = readHistory(config.StateDir, started.Add(time.Hour))
+	if err != nil || len(results) != 2 || results[0].ID != "bb02" {
+		t.Errorf("Expected only the later runs, got %+v (%v)", results, err)
+	}
+
+	results, err = readHistory(t.TempDir(), time.Time{})
+	if err != nil || len(results) != 0 {
+		t.Errorf("Expected no history in a new state dir, got %+v (%v)", results, err)
+	}
+}
+
+func TestHistoryRotation(t *testing.T) {
+	config := &Config{StateDir: t.TempDir()}
+	started := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	// each run carries 3 MiB of hook output, so the history rotates every fifth run
+	output := strings.Repeat("x", 3*1024*1024)
+
+	for i := 0; i < 12; i++ {
+		result := UpgradeResult{
+			ID:        fmt.Sprintf("%02x", i),
+			Trigger:   "cli",
+			StartedAt: started.Add(time.Duration(i) * time.Hour),
+			Hooks:     []HookResult{{Phase: HookPostUpgrade, Command: "cat big", Output: output}},
+		}
+		finishUpgradeResult(config, &result, nil)
+	}
+
+	path := filepath.Join(config.StateDir, historyFile)
+	for _, name := range []string{path, path + ".1"} {
+		info, err := os.Stat(name)
+		if err != nil || info.Size() > maxHistorySize {
+			t.Errorf("Expected %s to stay within %d bytes (%v)", name, maxHistorySize, err)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("Expected a single rotated history file")
+	}
+
+	results, err := readHistory(config.StateDir, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	// runs 00-04 were dropped, 05-09 are in the rotated file, 0a-0b in the current one
+	if len(results) != 7 || results[0].ID != "05" || results[6].ID != "0b" {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		t.Errorf("Unexpected history after rotation: %v", ids)
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		input string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"7d", now.AddDate(0, 0, -7)},
+		{"36h", now.Add(-36 * time.Hour)},
+		{"2026-03-01T08:00:00Z", time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{"2026-03-01", time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, test := range tests {
+		got, err := parseSince(test.input, now)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("parseSince(%q) = %v, %v, expected %v", test.input, got, err, test.want)
+		}
+	}
+
+	for _, input := range []string{"yesterday", "-1d", "-2h"} {
+		if _, err := parseSince(input, now); err == nil {
+			t.Errorf("Expected parseSince(%q) to fail", input)
+		}
+	}
+}
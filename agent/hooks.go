@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Hook phases
+const (
+	HookPreUpgrade  = "pre_upgrade"
+	HookPostUpgrade = "post_upgrade"
+)
+
+// maxHookOutput caps the output of a hook kept in the upgrade report
+const maxHookOutput = 64 * 1024
+
+// HookResult is the outcome of a single hook command
+type HookResult struct {
+	Phase    string        `json:"phase"`
+	Command  string        `json:"command"`
+	ExitCode int           `json:"exit_code"`
+	Output   string        `json:"output,omitempty"`
+	Duration time.Duration `json:"duration"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// executeUpgrade runs upgrade between the configured pre- and post-upgrade
+// hooks, after a snapshot of the root filesystem if enabled, and records
+// everything in result. A failing pre-upgrade hook aborts
+// the upgrade unless configured otherwise; a failing post-upgrade hook marks
+// the run as failed even though the packages were upgraded.
+func executeUpgrade(config *Config, result *UpgradeResult, upgrade func() error) error {
+	return withUpgradeLock(config, func() error {
+		return executeUpgradeLocked(config, result, upgrade)
+	})
+}
+
+func executeUpgradeLocked(config *Config, result *UpgradeResult, upgrade func() error) error {
+	env := hookEnv(config, result)
+
+	for _, command := range config.Hooks.PreUpgrade {
+		hook := runHook(config, HookPreUpgrade, command, env)
+		result.Hooks = append(result.Hooks, hook)
+		if hook.Error != "" && config.Hooks.AbortOnPreFailure {
+			return fmt.Errorf("pre-upgrade hook %q failed, upgrade aborted: %s", command, hook.Error)
+		}
+	}
+
+	if config.Snapshot.Enabled {
+		snapshot, err := takeSnapshot(&config.Snapshot, result.ID)
+		result.Snapshot = snapshot
+		if err != nil {
+			log.Printf("Error taking pre-upgrade snapshot: %v\n", err)
+			if config.Snapshot.AbortOnFailure {
+				return fmt.Errorf("upgrade aborted: %v", err)
+			}
+		}
+	}
+
+	upgradeErr := recordChanges(config, result, upgrade)
+	reboot := detectRebootRequired()
+	result.Reboot = &reboot
+	if config.Services.Check {
+		result.Services = checkServices(config)
+	}
+
+	env = append(env,
+		fmt.Sprintf("REDT_UPGRADE_SUCCESS=%t", upgradeErr == nil),
+		fmt.Sprintf("REDT_REBOOT_REQUIRED=%t", reboot.Required),
+	)
+	if upgradeErr != nil {
+		env = append(env, "REDT_UPGRADE_ERROR="+upgradeErr.Error())
+	}
+	var hookErr error
+	for _, command := range config.Hooks.PostUpgrade {
+		hook := runHook(config, HookPostUpgrade, command, env)
+		result.Hooks = append(result.Hooks, hook)
+		if hook.Error != "" && hookErr == nil {
+			hookErr = fmt.Errorf("post-upgrade hook %q failed: %s", command, hook.Error)
+		}
+	}
+
+	if upgradeErr != nil {
+		return upgradeErr
+	}
+	return hookErr
+}
+
+// hookEnv describes the upgrade to hooks. The plan is only computed when
+// hooks are configured, since planning runs the package manager, and is kept
+// in the result.
+func hookEnv(config *Config, result *UpgradeResult) []string {
+	if len(config.Hooks.PreUpgrade) == 0 && len(config.Hooks.PostUpgrade) == 0 {
+		return nil
+	}
+
+	env := append(os.Environ(),
+		"REDT_UPGRADE_ID="+result.ID,
+		"REDT_UPGRADE_TRIGGER="+result.Trigger,
+		"REDT_INSTRUCTION_ID="+result.InstructionID,
+	)
+
+	if result.Plan == nil {
+		plan, err := planUpgrade()
+		if err != nil {
+			log.Printf("Error computing upgrade plan for hooks: %v\n", err)
+			return env
+		}
+		result.Plan = plan
+	}
+
+	var names []string
+	for _, pkgs := range [][]PackageInfo{result.Plan.Upgrades, result.Plan.Installs, result.Plan.Removals} {
+		for _, pkg := range pkgs {
+			names = append(names, pkg.Name)
+		}
+	}
+	planJSON, _ := json.Marshal(result.Plan)
+
+	return append(env,
+		"REDT_UPGRADE_PACKAGES="+strings.Join(names, " "),
+		"REDT_UPGRADE_PLAN="+string(planJSON),
+	)
+}
+
+func runHook(config *Config, phase, command string, env []string) HookResult {
+	hook := HookResult{Phase: phase, Command: command}
+	log.Printf("Running %s hook: %s\n", phase, command)
+
+	ctx := context.Background()
+	if config.Hooks.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Hooks.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(env, "REDT_HOOK_PHASE="+phase)
+	// run in its own process group so a timeout also kills anything the hook started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	var output limitedBuffer
+	output.limit = maxHookOutput
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	started := time.Now()
+	err := cmd.Run()
+	hook.Duration = time.Since(started)
+	hook.Output = output.String()
+	hook.ExitCode = cmd.ProcessState.ExitCode()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		hook.TimedOut = true
+		hook.Error = fmt.Sprintf("timed out after %s", config.Hooks.Timeout)
+	} else if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			hook.Error = fmt.Sprintf("exited with status %d", hook.ExitCode)
+		} else {
+			hook.Error = err.Error()
+		}
+	}
+
+	if hook.Error != "" {
+		log.Printf("%s hook %q failed: %s\n", phase, command, hook.Error)
+	}
+	return hook
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + "\n[output truncated]"
+	}
+	return b.Buffer.String()
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	config := &Config{Hooks: HooksConfig{Timeout: 5 * time.Second}}
+
+	hook := runHook(config, HookPreUpgrade, `echo "$REDT_HOOK_PHASE $REDT_UPGRADE_ID"`, []string{"REDT_UPGRADE_ID=abc"})
+	if hook.Error != "" || hook.ExitCode != 0 {
+		t.Fatalf("Expected hook to succeed, got %+v", hook)
+	}
+	if strings.TrimSpace(hook.Output) != "pre_upgrade abc" {
+		t.Errorf("Unexpected hook output %q", hook.Output)
+	}
+
+	hook = runHook(config, HookPostUpgrade, "echo failing >&2; exit 3", nil)
+	if hook.ExitCode != 3 || hook.Error == "" || !strings.Contains(hook.Output, "failing") {
+		t.Errorf("Expected failing hook with exit code 3 and its stderr, got %+v", hook)
+	}
+
+	config.Hooks.Timeout = 100 * time.Millisecond
+	started := time.Now()
+	hook = runHook(config, HookPreUpgrade, "sleep 10 & wait", nil)
+	if !hook.TimedOut || hook.Error == "" {
+		t.Errorf("Expected hook to time out, got %+v", hook)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Errorf("Timed out hook was not killed promptly")
+	}
+}
+
+func TestExecuteUpgradeHooks(t *testing.T) {
+	config := &Config{StateDir: t.TempDir(), Hooks: HooksConfig{
+		PreUpgrade:        []string{"exit 1"},
+		PostUpgrade:       []string{"true"},
+		Timeout:           5 * time.Second,
+		AbortOnPreFailure: true,
+	}}
+
+	upgraded := false
+	upgrade := func() error {
+		upgraded = true
+		return nil
+	}
+
+	plan := &UpgradePlan{Upgrades: []PackageInfo{{Name: "curl"}, {Name: "openssl"}}}
+	result := UpgradeResult{Plan: plan}
+	if err := executeUpgrade(config, &result, upgrade); err == nil {
+		t.Fatal("Expected failing pre-upgrade hook to abort the upgrade")
+	}
+	if upgraded || len(result.Hooks) != 1 {
+		t.Errorf("Expected only the pre-upgrade hook to run, upgraded=%v hooks=%+v", upgraded, result.Hooks)
+	}
+
+	config.Hooks.AbortOnPreFailure = false
+	config.Hooks.PostUpgrade = []string{`test "$REDT_UPGRADE_SUCCESS" = true -a "$REDT_UPGRADE_PACKAGES" = "curl openssl"`, "exit 2"}
+	result = UpgradeResult{Plan: plan}
+	err := executeUpgrade(config, &result, upgrade)
+	if !upgraded || len(result.Hooks) != 3 {
+		t.Fatalf("Expected upgrade and all hooks to run, upgraded=%v hooks=%+v", upgraded, result.Hooks)
+	}
+	if result.Hooks[1].Error != "" {
+		t.Errorf("Expected upgrade outcome and planned packages in post-upgrade hook environment, got %+v", result.Hooks[1])
+	}
+	if err == nil {
+		t.Error("Expected failing post-upgrade hook to fail the upgrade")
+	}
+}
@@ -0,0 +1,287 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPClient builds the client used for every backend request from the
+// TLS, timeout and proxy settings
+func newHTTPClient(config TLSConfig, network NetworkConfig) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newProxyFunc(network.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	if network.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   network.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = network.ConnectTimeout
+	}
+	transport.ResponseHeaderTimeout = network.ReadTimeout
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   network.Timeout,
+	}, nil
+}
+
+// newProxyFunc returns the proxy selection for backend requests. Without an
+// explicit proxy URL the standard HTTP(S)_PROXY and NO_PROXY variables apply.
+func newProxyFunc(config ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	if config.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(config.URL)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q", config.URL)
+	}
+	if config.Username != "" {
+		proxyURL.User = url.UserPassword(config.Username, config.Password)
+	}
+
+	noProxy := config.NoProxy
+	if len(noProxy) == 0 {
+		noProxy = strings.Split(firstEnv("NO_PROXY", "no_proxy"), ",")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether target matches a NO_PROXY entry. Entries are
+// "*", host names (matching the host and its subdomains, with an optional
+// leading dot), IP addresses and CIDR ranges, each with an optional ":port".
+func bypassProxy(target *url.URL, noProxy []string) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[target.Scheme]
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(entryHost, ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[config.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls.min_version %q", config.MinVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: config.ServerName,
+	}
+
+	// a configured CA bundle replaces the system roots
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(config.PinnedSHA256) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range config.PinnedSHA256 {
+			pins[normalizePin(pin)] = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPinnedKey(state, pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPinnedKey accepts the connection if any certificate in the verified
+// chain has a pinned SHA-256 subject public key info hash.
+func verifyPinnedKey(state tls.ConnectionState, pins map[string]bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("backend presented no certificate")
+	}
+
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if pins[spkiHash(cert)] {
+				return nil
+			}
+		}
+	}
+
+	return &PinMismatchError{
+		ServerName: state.ServerName,
+		Got:        spkiHash(state.PeerCertificates[0]),
+	}
+}
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizePin accepts pins written as hex with optional "sha256:" prefix and colons
+func normalizePin(pin string) string {
+	pin = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(pin)), "sha256:")
+	return strings.ReplaceAll(pin, ":", "")
+}
+
+// PinMismatchError is returned when the backend's key is not one of the pinned keys
+type PinMismatchError struct {
+	ServerName string
+	Got        string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("backend certificate for %s does not match any pinned key (got sha256:%s)", e.ServerName, e.Got)
+}
+
+// backendClient returns the configured client, or the default client for configs
+// that were not built by LoadConfig.
+func backendClient(config *Config) *http.Client {
+	if config.HTTPClient != nil {
+		return config.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// doBackendRequest sends req with the backend client, authenticated with the
+// host's credential, and turns certificate failures into errors that say what
+// did not match. A rotation requested by the backend is carried out before returning.
+func doBackendRequest(config *Config, req *http.Request) (*http.Response, error) {
+	return doBackendRequestWith(config, backendClient(config), req)
+}
+
+// doBackendRequestWith is doBackendRequest for requests that need a client
+// with different timeouts, such as long polls
+func doBackendRequestWith(config *Config, client *http.Client, req *http.Request) (*http.Response, error) {
+	credentialMu.RLock()
+	token := config.Token
+	credentialMu.RUnlock()
+	if token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, describeTLSError(err)
+	}
+
+	if resp.Header.Get(rotateCredentialHeader) == "true" {
+		if err := rotateCredential(config); err != nil {
+			log.Printf("Error rotating credential: %v\n", err)
+		}
+	}
+	return resp, nil
+}
+
+func describeTLSError(err error) error {
+	var pinErr *PinMismatchError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &pinErr):
+		return err
+	case errors.As(err, &unknownAuthority):
+		return fmt.Errorf("backend certificate is not signed by a trusted CA (check tls.ca_file): %w", err)
+	case errors.As(err, &hostnameErr):
+		return fmt.Errorf("backend certificate does not match the expected host name (check tls.server_name): %w", err)
+	case errors.As(err, &invalidErr):
+		return fmt.Errorf("backend certificate is invalid: %w", err)
+	}
+	return err
+}
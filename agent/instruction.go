@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Instruction actions
+const (
+	ActionUpgrade       = "upgrade"
+	ActionInventory     = "inventory"
+	ActionCancelUpgrade = "cancel_upgrade"
+	ActionRefreshConfig = "refresh_config"
+	ActionRollback      = "rollback"
+	ActionInstall       = "install"
+	ActionRemove        = "remove"
+)
+
+const (
+	// maxClockSkew is how far in the future an instruction's issue time may be
+	maxClockSkew = 5 * time.Minute
+
+	maxInstructionSize = 64 * 1024
+)
+
+// Instruction is an action the backend asks the agent to perform. It is
+// delivered as the base64 payload of a SignedInstruction.
+type Instruction struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	AgentID   string    `json:"agent_id,omitempty"` // when set, only this agent may act on it
+	Hostname  string    `json:"hostname,omitempty"` // when set, only this host may act on it
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	NotBefore time.Time `json:"not_before,omitempty"` // defers an upgrade, which stays pending until then
+	DryRun    bool      `json:"dry_run,omitempty"`    // report the upgrade plan without changing the system
+	Nonce     string    `json:"nonce"`
+	UpgradeID string    `json:"upgrade_id,omitempty"` // the recorded upgrade a rollback reverts
+	Packages  []string  `json:"packages,omitempty"`   // what install and remove act on
+
+	// staged rollouts, see applyRollout
+	Groups   []string `json:"groups,omitempty"`    // when set, only hosts in one of these rollout groups act on it
+	Rollout  string   `json:"rollout,omitempty"`   // identifies the rollout across instructions raising Percent
+	Percent  int      `json:"percent,omitempty"`   // share of hosts that act on it, 0 means all
+	MaxDelay int      `json:"max_delay,omitempty"` // seconds after issued_at over which hosts spread the upgrade
+}
+
+// SignedInstruction carries an Ed25519 signature over the exact payload bytes,
+// which the backend produces as canonical JSON (sorted keys, no whitespace).
+type SignedInstruction struct {
+	Payload   string `json:"payload"`   // base64
+	Signature string `json:"signature"` // base64
+}
+
+// InstructionVerifier checks signatures, expiry, targeting and nonces of
+// backend instructions. It remembers nonces until their instruction expires
+// so that a captured instruction cannot be replayed.
+type InstructionVerifier struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	now  func() time.Time
+}
+
+func NewInstructionVerifier() *InstructionVerifier {
+	return &InstructionVerifier{
+		seen: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+// Verify parses body as a SignedInstruction and returns the instruction if it
+// may be acted upon by this agent.
+func (v *InstructionVerifier) Verify(config *Config, body []byte) (*Instruction, error) {
+	var signed SignedInstruction
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &signed); err != nil {
+			return nil, fmt.Errorf("malformed instruction: %v", err)
+		}
+	}
+
+	if signed.Signature == "" {
+		if !config.Instructions.AllowUnsigned {
+			return nil, errors.New("instruction is not signed")
+		}
+		// legacy backends signal an upgrade with a bare 200 response
+		return &Instruction{Action: ActionUpgrade}, nil
+	}
+
+	if len(config.Instructions.PublicKeys) == 0 {
+		return nil, errors.New("no instruction public key configured")
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed instruction payload: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed instruction signature: %v", err)
+	}
+
+	verified := false
+	for _, key := range config.Instructions.PublicKeys {
+		if ed25519.Verify(key, payload, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("instruction signature does not match any configured public key")
+	}
+
+	var instruction Instruction
+	if err := json.Unmarshal(payload, &instruction); err != nil {
+		return nil, fmt.Errorf("malformed instruction payload: %v", err)
+	}
+
+	if err := v.check(config, &instruction); err != nil {
+		return nil, fmt.Errorf("instruction %s: %v", instruction.ID, err)
+	}
+	return &instruction, nil
+}
+
+func (v *InstructionVerifier) check(config *Config, instruction *Instruction) error {
+	now := v.now()
+
+	if instruction.ID == "" || instruction.Nonce == "" {
+		return errors.New("missing id or nonce")
+	}
+	if instruction.ExpiresAt.IsZero() || !now.Before(instruction.ExpiresAt) {
+		return fmt.Errorf("expired at %s", instruction.ExpiresAt.Format(time.RFC3339))
+	}
+	if instruction.IssuedAt.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("issued in the future at %s", instruction.IssuedAt.Format(time.RFC3339))
+	}
+	credentialMu.RLock()
+	agentID := config.AgentID
+	credentialMu.RUnlock()
+	if instruction.AgentID != "" && instruction.AgentID != agentID {
+		return fmt.Errorf("addressed to agent %s", instruction.AgentID)
+	}
+	if instruction.Hostname != "" && instruction.Hostname != config.Hostname {
+		return fmt.Errorf("addressed to host %s", instruction.Hostname)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for nonce, expiresAt := range v.seen {
+		if !now.Before(expiresAt) {
+			delete(v.seen, nonce)
+		}
+	}
+	if _, ok := v.seen[instruction.Nonce]; ok {
+		return fmt.Errorf("replayed nonce %s", instruction.Nonce)
+	}
+	v.seen[instruction.Nonce] = instruction.ExpiresAt
+
+	return nil
+}
+
+// SeenNonces returns the remembered nonces with the expiry of their instructions
+func (v *InstructionVerifier) SeenNonces() map[string]time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	seen := make(map[string]time.Time, len(v.seen))
+	for nonce, expiresAt := range v.seen {
+		seen[nonce] = expiresAt
+	}
+	return seen
+}
+
+// RestoreSeenNonces remembers nonces seen before a restart, so that their
+// instructions cannot be replayed after it
+func (v *InstructionVerifier) RestoreSeenNonces(seen map[string]time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for nonce, expiresAt := range seen {
+		v.seen[nonce] = expiresAt
+	}
+}
+
+// parsePublicKeys decodes base64 Ed25519 public keys from the configuration
+func parsePublicKeys(encoded []string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instruction public key %q: %v", s, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid instruction public key %q: expected %d bytes, got %d", s, ed25519.PublicKeySize, len(key))
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
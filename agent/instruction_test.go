@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signInstruction(t *testing.T, key ed25519.PrivateKey, instruction Instruction) []byte {
+	payload, err := json.Marshal(instruction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(SignedInstruction{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestInstructionVerifier(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	valid := func(nonce string) Instruction {
+		return Instruction{
+			ID:        "instr-" + nonce,
+			Action:    ActionUpgrade,
+			AgentID:   "agent-1",
+			IssuedAt:  now.Add(-time.Minute),
+			ExpiresAt: now.Add(time.Hour),
+			Nonce:     nonce,
+		}
+	}
+	expired := valid("expired")
+	expired.ExpiresAt = now.Add(-time.Second)
+	otherAgent := valid("other-agent")
+	otherAgent.AgentID = "agent-2"
+
+	testConfig := getTestConfig()
+	testConfig.AgentID = "agent-1"
+	testConfig.Instructions.PublicKeys = []ed25519.PublicKey{publicKey}
+
+	verifier := NewInstructionVerifier()
+	verifier.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr bool
+	}{
+		{"Valid instruction", signInstruction(t, privateKey, valid("a")), false},
+		{"Replayed nonce", signInstruction(t, privateKey, valid("a")), true},
+		{"Signed with another key", signInstruction(t, otherKey, valid("b")), true},
+		{"Expired", signInstruction(t, privateKey, expired), true},
+		{"Addressed to another agent", signInstruction(t, privateKey, otherAgent), true},
+		{"Unsigned", []byte{}, true},
+		{"Malformed", []byte("upgrade please"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifier.Verify(testConfig, tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
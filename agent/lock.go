@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const upgradeLockFile = "upgrade.lock"
+
+// LockedError reports that another process holds a lock an upgrade needs
+type LockedError struct {
+	Lock    string // "upgrade" for the agent's own lock, otherwise the lock file
+	PID     int    // zero if unknown
+	Command string
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.Lock)
+	}
+	if e.Command == "" {
+		return fmt.Sprintf("%s is locked by pid %d", e.Lock, e.PID)
+	}
+	return fmt.Sprintf("%s is locked by pid %d (%s)", e.Lock, e.PID, e.Command)
+}
+
+// fcntlLocks are held with fcntl(F_SETLK) by dpkg, apt and rpm while they
+// change the system
+var fcntlLocks = []string{
+	"/var/lib/dpkg/lock-frontend",
+	"/var/lib/dpkg/lock",
+	"/var/lib/apt/lists/lock",
+	"/var/cache/apt/archives/lock",
+	"/var/lib/rpm/.rpm.lock",
+}
+
+// pidLocks are files holding the PID of a running dnf or yum
+var pidLocks = []string{
+	"/var/run/dnf.pid",
+	"/var/run/dnf.rpmdb.pid",
+	"/var/run/yum.pid",
+}
+
+// acquireUpgradeLock takes the agent-wide upgrade lock shared by sysup and
+// the daemon. It fails right away with a LockedError if another agent
+// process is upgrading. The lock is released by calling the returned function.
+func acquireUpgradeLock(stateDir string) (func(), error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create upgrade lock: %v", err)
+	}
+	path := filepath.Join(stateDir, upgradeLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upgrade lock: %v", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			data, _ := os.ReadFile(path)
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+			return nil, &LockedError{Lock: "upgrade", PID: pid, Command: processName(pid)}
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	// the PID is only informational; the flock is what excludes other processes
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	return func() {
+		f.Truncate(0)
+		f.Close()
+	}, nil
+}
+
+// waitForPackageManager waits until no package manager holds its locks, or
+// returns a LockedError naming the holder after timeout. Locks it cannot
+// inspect, e.g. dpkg's root-only lock files from an unprivileged daemon, are
+// logged and left to the package manager's own locking.
+func waitForPackageManager(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		locked, err := packageManagerLocked()
+		if err != nil {
+			log.Printf("Not waiting for the package manager: %v\n", err)
+			return nil
+		}
+		if locked == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("gave up after waiting %s: %w", timeout, locked)
+		}
+		if !logged {
+			log.Printf("Waiting up to %s for the package manager: %v\n", timeout, locked)
+			logged = true
+		}
+		time.Sleep(min(5*time.Second, time.Until(deadline)))
+	}
+}
+
+// packageManagerLocked returns a LockedError for the first package manager
+// lock held, or an error if a lock could not be inspected
+func packageManagerLocked() (*LockedError, error) {
+	for _, path := range fcntlLocks {
+		pid, err := fcntlLockHolder(path)
+		if err != nil {
+			return nil, err
+		}
+		if pid != 0 {
+			return &LockedError{Lock: path, PID: pid, Command: processName(pid)}, nil
+		}
+	}
+	for _, path := range pidLocks {
+		if pid := pidFileHolder(path); pid != 0 {
+			return &LockedError{Lock: path, PID: pid, Command: processName(pid)}, nil
+		}
+	}
+	return nil, nil
+}
+
+// fcntlLockHolder returns the PID holding a write lock on path, or zero if
+// it is unlocked or does not exist
+func fcntlLockHolder(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot determine whether %s is locked: %v", path, err)
+	}
+	defer f.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return 0, fmt.Errorf("cannot determine whether %s is locked: %v", path, err)
+	}
+	if lock.Type == syscall.F_UNLCK {
+		return 0, nil
+	}
+	return int(lock.Pid), nil
+}
+
+// pidFileHolder returns the PID in path if that process is still running, or zero
+func pidFileHolder(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	return pid
+}
+
+func processName(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// withUpgradeLock runs fn holding the agent-wide upgrade lock. If the lock
+// cannot be taken, e.g. because the state directory is not writable, fn does
+// not run: upgrading unlocked could race another agent process.
+func withUpgradeLock(config *Config, fn func() error) error {
+	release, err := acquireUpgradeLock(config.StateDir)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return fn()
+}
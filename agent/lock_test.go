@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestUpgradeLock(t *testing.T) {
+	stateDir := t.TempDir()
+
+	release, err := acquireUpgradeLock(stateDir)
+	if err != nil {
+		t.Fatalf("Failed to acquire upgrade lock: %v", err)
+	}
+
+	_, err = acquireUpgradeLock(stateDir)
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.PID != os.Getpid() {
+		t.Fatalf("Expected upgrade lock held by pid %d, got %v", os.Getpid(), err)
+	}
+
+	config := &Config{StateDir: stateDir}
+	ran := false
+	err = withUpgradeLock(config, func() error {
+		ran = true
+		return nil
+	})
+	if ran || !errors.As(err, &locked) {
+		t.Errorf("Expected withUpgradeLock to refuse while locked, ran=%v err=%v", ran, err)
+	}
+
+	release()
+	if err := withUpgradeLock(config, func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("Expected withUpgradeLock to run after release, ran=%v err=%v", ran, err)
+	}
+
+	// a state directory that cannot be created fails instead of running unlocked
+	file := filepath.Join(stateDir, "file")
+	os.WriteFile(file, nil, 0600)
+	ran = false
+	if err := withUpgradeLock(&Config{StateDir: filepath.Join(file, "state")}, func() error { ran = true; return nil }); err == nil || ran {
+		t.Errorf("Expected withUpgradeLock to fail without a state directory, ran=%v err=%v", ran, err)
+	}
+}
+
+func TestFcntlLockHolder(t *testing.T) {
+	dir := t.TempDir()
+
+	if pid, err := fcntlLockHolder(filepath.Join(dir, "missing")); pid != 0 || err != nil {
+		t.Errorf("Expected a missing lock file to be unlocked, got %d, %v", pid, err)
+	}
+
+	unlocked := filepath.Join(dir, "lock")
+	os.WriteFile(unlocked, nil, 0640)
+	if pid, err := fcntlLockHolder(unlocked); pid != 0 || err != nil {
+		t.Errorf("Expected an unlocked lock file, got %d, %v", pid, err)
+	}
+
+	// like dpkg's root-only locks seen by an unprivileged user, the lock cannot be inspected
+	if _, err := fcntlLockHolder(filepath.Join(unlocked, "lock")); err == nil {
+		t.Error("Expected an error for a lock file that cannot be opened")
+	}
+}
+
+func TestPidFileHolder(t *testing.T) {
+	dir := t.TempDir()
+
+	running := filepath.Join(dir, "running.pid")
+	os.WriteFile(running, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if pid := pidFileHolder(running); pid != os.Getpid() {
+		t.Errorf("Expected pid %d, got %d", os.Getpid(), pid)
+	}
+
+	// PIDs wrap well below this
+	stale := filepath.Join(dir, "stale.pid")
+	os.WriteFile(stale, []byte("999999999\n"), 0644)
+	if pid := pidFileHolder(stale); pid != 0 {
+		t.Errorf("Expected stale pid file to be ignored, got %d", pid)
+	}
+
+	if pid := pidFileHolder(filepath.Join(dir, "missing.pid")); pid != 0 {
+		t.Errorf("Expected missing pid file to be ignored, got %d", pid)
+	}
+}
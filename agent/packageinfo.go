@@ -1,16 +1,19 @@
 package agent
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/bluet/redt-agent/utils"
+	"github.com/bluet/redt-agent/version"
 )
 
 type DefaultPackageInfoProvider struct{}
@@ -25,10 +28,36 @@ func (r *DefaultPackageInfoReporter) ReportPackageInfo(config *Config, packages
 	return reportPackageInfo(config, packages)
 }
 
-type DefaultUpgradeChecker struct{}
+func (r *DefaultPackageInfoReporter) ReportRepositories(config *Config, repos []Repository) error {
+	return reportRepositories(config, repos)
+}
+
+type DefaultUpgradeChecker struct {
+	Verifier *InstructionVerifier // required, shared across checks to reject replays
+	Reporter UpgradeResultReporter
 
-func (d DefaultUpgradeChecker) CheckAndPerformUpgrade(config *Config) error {
-	return checkAndPerformUpgrade(config)
+	// Defer receives an upgrade deferred by NotBefore or rollout staggering.
+	// The daemon keeps it in the same slot as deferred upgrade commands, so
+	// that cancel_upgrade applies to either.
+	Defer func(instruction *Instruction)
+}
+
+func (d *DefaultUpgradeChecker) CheckAndPerformUpgrade(config *Config) error {
+	pending, err := checkAndPerformUpgrade(config, d.Verifier, d.Reporter)
+	if pending != nil {
+		if d.Defer == nil {
+			log.Printf("Dropping deferred upgrade %s: nothing to run it later\n", pending.ID)
+		} else {
+			d.Defer(pending)
+		}
+	}
+	return err
+}
+
+type DefaultUpgradeResultReporter struct{}
+
+func (r *DefaultUpgradeResultReporter) ReportUpgradeResult(config *Config, result UpgradeResult) error {
+	return reportUpgradeResult(config, result)
 }
 
 type DefaultUpgradePerformer struct{}
@@ -44,7 +73,7 @@ func getPackageInfo() ([]PackageInfo, error) {
 	}
 
 	var cmd *exec.Cmd
-	var parseFunc func(string) []PackageInfo
+	var parseFunc func(string) ([]PackageInfo, []string)
 
 	// TODO: support more package managers
 	// TODO: support other operating systems
@@ -61,20 +90,56 @@ func getPackageInfo() ([]PackageInfo, error) {
 	}
 
 	out, err := cmd.Output()
-	if err != nil {
+	// check-update exits with 100 when updates are available
+	var exitErr *exec.ExitError
+	if err != nil && !(pm != "apt-get" && errors.As(err, &exitErr) && exitErr.ExitCode() == 100) {
 		return nil, err
 	}
 
-	return parseFunc(string(out)), nil
+	packages, warnings := parseFunc(string(out))
+	for _, warning := range warnings {
+		log.Printf("Warning parsing %s output: %s\n", pm, warning)
+	}
+	if pm != "apt-get" {
+		fillInstalledRPMVersions(packages)
+	}
+	setUpdateTypes(pm, packages)
+	return packages, nil
+}
+
+// versionFormat returns the version syntax of the packages of a package manager
+func versionFormat(pm string) version.Format {
+	if pm == "apt-get" {
+		return version.Deb
+	}
+	return version.RPM
+}
+
+// setUpdateTypes classifies each update as a major, minor or patch update
+func setUpdateTypes(pm string, packages []PackageInfo) {
+	for i := range packages {
+		if packages[i].Version != "" && packages[i].NewVersion != "" {
+			packages[i].UpdateType = version.UpdateType(versionFormat(pm), packages[i].Version, packages[i].NewVersion)
+		}
+	}
 }
 
 func reportPackageInfo(config *Config, packages []PackageInfo) error {
-	data, err := json.Marshal(packages)
+	resp, err := postJSON(config, config.PackageEndpoint, packages)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.Post(config.PackageEndpoint, "application/json", bytes.NewBuffer(data))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func reportRepositories(config *Config, repos []Repository) error {
+	resp, err := postJSON(config, config.RepositoryEndpoint, repos)
 	if err != nil {
 		return err
 	}
@@ -87,29 +152,116 @@ func reportPackageInfo(config *Config, packages []PackageInfo) error {
 	return nil
 }
 
-func checkAndPerformUpgrade(config *Config) error {
-	client := &http.Client{}
+func reportUpgradeResult(config *Config, result UpgradeResult) error {
+	resp, err := postJSON(config, config.UpgradeResultEndpoint, result)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// checkAndPerformUpgrade polls the backend for an upgrade instruction and
+// runs it. An instruction that is not due yet is returned instead.
+func checkAndPerformUpgrade(config *Config, verifier *InstructionVerifier, reporter UpgradeResultReporter) (*Instruction, error) {
+	// hosts without a backend (e.g. only writing to the file sink) never receive instructions
+	if config.BackendURL == "" {
+		return nil, nil
+	}
+	if verifier == nil {
+		return nil, errors.New("no instruction verifier")
+	}
+
 	req, err := http.NewRequest("GET", config.UpgradeEndpoint, nil)
 	if err != nil {
 		log.Printf("Error creating upgrade request: %v\n", err)
-		return err
+		return nil, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doBackendRequest(config, req)
 	if err != nil {
 		log.Printf("Error checking for upgrades: %v\n", err)
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK {
-		err = performUpgrade(true)
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxInstructionSize))
+		if err != nil {
+			log.Printf("Error reading upgrade instruction: %v\n", err)
+			return nil, err
+		}
+
+		instruction, err := verifier.Verify(config, body)
+		if err != nil {
+			log.Printf("Rejected upgrade instruction from %s: %v\n", config.UpgradeEndpoint, err)
+			return nil, err
+		}
+		if instruction.Action == ActionRollback {
+			_, err = runInstructedRollback(config, instruction, reporter)
+			return nil, err
+		}
+		if instruction.Action == ActionInstall || instruction.Action == ActionRemove {
+			_, err = runInstructedPackageChange(config, instruction, reporter)
+			return nil, err
+		}
+		if instruction.Action != ActionUpgrade {
+			err := fmt.Errorf("unexpected instruction action %q", instruction.Action)
+			log.Printf("Rejected upgrade instruction %s: %v\n", instruction.ID, err)
+			return nil, err
+		}
+
+		if reason := applyRollout(config, instruction); reason != "" {
+			log.Printf("Skipping upgrade instruction %s: %s\n", instruction.ID, reason)
+			return nil, nil
+		}
+		if instruction.NotBefore.After(time.Now()) {
+			return instruction, nil
+		}
+
+		_, err = runInstructedUpgrade(config, instruction, reporter)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	return nil, nil
+}
+
+// runInstructedUpgrade upgrades the system on behalf of a verified backend
+// instruction, or only computes the plan for a dry run, and reports the outcome
+func runInstructedUpgrade(config *Config, instruction *Instruction, reporter UpgradeResultReporter) (UpgradeResult, error) {
+	result := UpgradeResult{
+		ID:            utils.RandomID(),
+		InstructionID: instruction.ID,
+		Hostname:      config.Hostname,
+		Trigger:       UpgradeTriggerBackend,
+		StartedAt:     time.Now(),
+		DryRun:        instruction.DryRun,
+	}
+
+	var err error
+	if instruction.DryRun {
+		result.Plan, err = planUpgrade()
+	} else {
+		err = executeUpgrade(config, &result, func() error {
+			return performUnattendedUpgrade(config)
+		})
+	}
+	finishUpgradeResult(config, &result, err)
+
+	if reporter != nil {
+		if reportErr := reporter.ReportUpgradeResult(config, result); reportErr != nil {
+			log.Printf("Error reporting upgrade result: %v\n", reportErr)
+		}
+	}
+
+	return result, err
 }
 
 func getPackageManager() (string, error) {
@@ -138,53 +290,7 @@ func getPackageManager() (string, error) {
 	return "", fmt.Errorf("package manager not found")
 }
 
-func parseAptGetOutput(output string) []PackageInfo {
-	// raw string: Inst libpulse-dev [1:15.99.1+dfsg1-1ubuntu2] (1:15.99.1+dfsg1-1ubuntu2.1 Ubuntu:22.04/jammy-updates [amd64]) []
-	// format: STATUS NAME [VERSION] (NEW_VERSION CATEGORY [ARCHITECTURES]) [OTHER_INFO]
-
-	lines := strings.Split(output, "\n")
-	var packages []PackageInfo
-
-	for _, line := range lines {
-		if strings.HasPrefix(line, "Inst") {
-			parts := strings.Fields(line)
-
-			packageInfo := PackageInfo{
-				Name:       parts[1],
-				Version:    strings.Trim(parts[2], "[]"),
-				NewVersion: strings.Trim(parts[3], "()"),
-				Category:   parts[4],
-				Arch:       strings.Trim(parts[5], "[]"),
-			}
-
-			packages = append(packages, packageInfo)
-		}
-	}
-
-	return packages
-}
-
-func parseDnfYumOutput(output string) []PackageInfo {
-	lines := strings.Split(output, "\n")
-	var packages []PackageInfo
-
-	for _, line := range lines {
-		parts := strings.Fields(line)
-
-		if len(parts) >= 3 {
-			packageInfo := PackageInfo{
-				Name:       parts[0],
-				Version:    parts[1],
-				NewVersion: parts[2],
-			}
-
-			packages = append(packages, packageInfo)
-		}
-	}
-
-	return packages
-}
-
+// performUpgrade upgrades interactively from a terminal; the daemon uses performUnattendedUpgrade
 func performUpgrade(autoYes bool) error {
 	fmt.Println("Upgrading packages...")
 
@@ -197,7 +303,6 @@ func performUpgrade(autoYes bool) error {
 	// TODO: support more package managers
 	// TODO: support other operating systems
 	// TODO: support multiple package managers
-	// TODO: when in daemon mode, no user interaction should be required
 	var cmdArgs []string
 	switch pm {
 	case "apt-get":
@@ -0,0 +1,310 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluet/redt-agent/utils"
+	"github.com/bluet/syspkg"
+	"github.com/bluet/syspkg/manager"
+)
+
+// Package operations recorded in UpgradeResult.Operation; upgrades leave it empty
+const (
+	OperationInstall = "install"
+	OperationRemove  = "remove"
+	OperationEnforce = "enforce" // installs and removes packages to match packages.must_have and must_not_have
+)
+
+// packageNameRegexp matches a package name, optionally qualified with an
+// architecture; in particular it can't start with "-" and pass an option
+var packageNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._~-]*(:[A-Za-z0-9_]+)?$`)
+
+// PackageDrift is how the installed packages differ from the desired state
+type PackageDrift struct {
+	Missing  []string `json:"missing,omitempty"`  // in packages.must_have but not installed
+	Unwanted []string `json:"unwanted,omitempty"` // in packages.must_not_have but installed
+}
+
+func (d *PackageDrift) empty() bool {
+	return len(d.Missing) == 0 && len(d.Unwanted) == 0
+}
+
+// packageDrift compares the installed packages with the desired state.
+// Entries are package names, optionally qualified with an architecture like
+// libc6:i386; an unqualified name matches the package in any architecture.
+func packageDrift(config *PackagesConfig, installed installedPackages) PackageDrift {
+	isInstalled := func(entry string) bool {
+		if name, arch, ok := strings.Cut(entry, ":"); ok {
+			return len(installed[name+" "+arch]) > 0
+		}
+		for key, versions := range installed {
+			if name, _, _ := strings.Cut(key, " "); name == entry && len(versions) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var drift PackageDrift
+	for _, entry := range config.MustHave {
+		if !isInstalled(entry) {
+			drift.Missing = append(drift.Missing, entry)
+		}
+	}
+	for _, entry := range config.MustNotHave {
+		if isInstalled(entry) {
+			drift.Unwanted = append(drift.Unwanted, entry)
+		}
+	}
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Unwanted)
+	return drift
+}
+
+// checkPackageDrift returns the drift from the desired state, or nil if no
+// desired state is configured
+func checkPackageDrift(config *PackagesConfig) (*PackageDrift, error) {
+	if len(config.MustHave) == 0 && len(config.MustNotHave) == 0 {
+		return nil, nil
+	}
+	pm, err := getPackageManager()
+	if err != nil {
+		return nil, err
+	}
+	installed, err := listInstalledPackages(pm)
+	if err != nil {
+		return nil, err
+	}
+	drift := packageDrift(config, installed)
+	return &drift, nil
+}
+
+// syspkgManager returns the syspkg backend for the host's package manager.
+// syspkg's yum backend also drives dnf, which provides yum on newer releases.
+func syspkgManager() (syspkg.PackageManager, error) {
+	pm, err := getPackageManager()
+	if err != nil {
+		return nil, err
+	}
+	name := "yum"
+	if pm == "apt-get" {
+		name = "apt"
+	}
+
+	sp, err := syspkg.New(syspkg.IncludeOptions{AllAvailable: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize package managers: %v", err)
+	}
+	return sp.GetPackageManager(name)
+}
+
+// changePackages installs or removes packages without asking for
+// confirmation. syspkg runs the package manager directly, so this needs root.
+func changePackages(operation string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%s needs root privileges", operation)
+	}
+	m, err := syspkgManager()
+	if err != nil {
+		return err
+	}
+
+	opts := &manager.Options{AssumeYes: true}
+	log.Printf("Running package %s of %s\n", operation, strings.Join(names, " "))
+	switch operation {
+	case OperationInstall:
+		_, err = m.Install(names, opts)
+	case OperationRemove:
+		_, err = m.Delete(names, opts)
+	default:
+		return fmt.Errorf("unsupported package operation %q", operation)
+	}
+	if err != nil {
+		return fmt.Errorf("package %s of %s failed: %v", operation, strings.Join(names, " "), err)
+	}
+	return nil
+}
+
+// applyDesiredState installs the missing and removes the unwanted packages
+func applyDesiredState(config *PackagesConfig) error {
+	drift, err := checkPackageDrift(config)
+	if err != nil || drift == nil {
+		return err
+	}
+	installErr := changePackages(OperationInstall, drift.Missing)
+	// removals go ahead even if an install failed, they don't depend on it
+	removeErr := changePackages(OperationRemove, drift.Unwanted)
+	return errors.Join(installErr, removeErr)
+}
+
+// executePackageChange runs change holding the upgrade lock and records the
+// packages it changed in result, so that it shows up in the history and can
+// be rolled back like an upgrade
+func executePackageChange(config *Config, result *UpgradeResult, change func() error) error {
+	return withUpgradeLock(config, func() error {
+		return recordChanges(config, result, change)
+	})
+}
+
+// enforceDesiredState brings the installed packages to the desired state. An
+// unprivileged daemon delegates to the root helper, which applies its own
+// configuration, and otherwise fails.
+func enforceDesiredState(config *Config, result *UpgradeResult) error {
+	return executePackageChange(config, result, func() error {
+		if os.Geteuid() != 0 && config.Upgrades.HelperSocket != "" {
+			output, err := callHelper(config.Upgrades.HelperSocket, HelperOpEnforcePackages)
+			if output != "" {
+				log.Printf("Package output from helper:\n%s", output)
+			}
+			return err
+		}
+		return applyDesiredState(&config.Packages)
+	})
+}
+
+// remediatePackages enforces the desired state if the host drifted from it
+func remediatePackages(config *Config, reporter UpgradeResultReporter) {
+	drift, err := checkPackageDrift(&config.Packages)
+	if err != nil {
+		log.Printf("Error checking package drift: %v\n", err)
+		return
+	}
+	if drift == nil || drift.empty() {
+		return
+	}
+	log.Printf("Remediating package drift: missing %v, unwanted %v\n", drift.Missing, drift.Unwanted)
+
+	result := UpgradeResult{
+		ID:        utils.RandomID(),
+		Hostname:  config.Hostname,
+		Trigger:   UpgradeTriggerRemediation,
+		Operation: OperationEnforce,
+		StartedAt: time.Now(),
+	}
+	err = enforceDesiredState(config, &result)
+	finishUpgradeResult(config, &result, err)
+	if err != nil {
+		log.Printf("Error remediating package drift: %v\n", err)
+	}
+
+	if reporter != nil {
+		if reportErr := reporter.ReportUpgradeResult(config, result); reportErr != nil {
+			log.Printf("Error reporting remediation result: %v\n", reportErr)
+		}
+	}
+}
+
+// validatePackageChange rejects a package change that cannot succeed, before
+// anything runs. Installing and removing packages needs root: the root helper
+// only enforces its own packages.must_have and must_not_have, so a daemon
+// running unprivileged cannot act on install and remove instructions.
+func validatePackageChange(operation string, names []string, privileged bool) error {
+	if operation != OperationInstall && operation != OperationRemove {
+		return fmt.Errorf("unsupported package operation %q", operation)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%s without packages", operation)
+	}
+	for _, name := range names {
+		if !packageNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid package name %q", name)
+		}
+	}
+	if !privileged {
+		return fmt.Errorf("%s needs the agent to run as root, the root helper only enforces packages.must_have and must_not_have", operation)
+	}
+	return nil
+}
+
+// RunPackageChange installs or removes packages from the command line
+func RunPackageChange(operation string, names []string, autoYes bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+	if err := validatePackageChange(operation, names, true); err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%s needs root privileges, run it with sudo", operation)
+	}
+
+	if !autoYes {
+		fmt.Printf("Do you want to %s %s? (y/N) ", operation, strings.Join(names, " "))
+		var answer string
+		fmt.Scanln(&answer)
+		if answer != "y" && answer != "Y" {
+			return nil
+		}
+	}
+
+	result := UpgradeResult{
+		ID:        utils.RandomID(),
+		Hostname:  config.Hostname,
+		Trigger:   UpgradeTriggerCLI,
+		Operation: operation,
+		StartedAt: time.Now(),
+	}
+	err = executePackageChange(config, &result, func() error {
+		return changePackages(operation, names)
+	})
+	finishUpgradeResult(config, &result, err)
+
+	if config.FileSink.Enabled {
+		sink, sinkErr := NewFileSink(config.FileSink)
+		if sinkErr != nil {
+			return fmt.Errorf("Error opening file sink: %v", sinkErr)
+		}
+		defer sink.Close()
+		if sinkErr := sink.ReportUpgradeResult(config, result); sinkErr != nil {
+			return fmt.Errorf("Error recording package %s result: %v", operation, sinkErr)
+		}
+	}
+
+	for _, change := range result.Changes {
+		fmt.Printf("  - %s (%s): %s -> %s\n", change.Name, change.Arch, change.OldVersion, change.NewVersion)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Package %s %s completed successfully.\n", operation, result.ID)
+	return nil
+}
+
+// runInstructedPackageChange installs or removes the packages of a verified
+// backend instruction and reports the outcome
+func runInstructedPackageChange(config *Config, instruction *Instruction, reporter UpgradeResultReporter) (UpgradeResult, error) {
+	result := UpgradeResult{
+		ID:            utils.RandomID(),
+		InstructionID: instruction.ID,
+		Hostname:      config.Hostname,
+		Trigger:       UpgradeTriggerBackend,
+		Operation:     instruction.Action,
+		StartedAt:     time.Now(),
+	}
+
+	err := validatePackageChange(instruction.Action, instruction.Packages, os.Geteuid() == 0)
+	if err == nil {
+		err = executePackageChange(config, &result, func() error {
+			return changePackages(instruction.Action, instruction.Packages)
+		})
+	}
+	finishUpgradeResult(config, &result, err)
+
+	if reporter != nil {
+		if reportErr := reporter.ReportUpgradeResult(config, result); reportErr != nil {
+			log.Printf("Error reporting package %s result: %v\n", instruction.Action, reportErr)
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingResultReporter keeps the results it is asked to report
+type recordingResultReporter struct {
+	results []UpgradeResult
+}
+
+func (r *recordingResultReporter) ReportUpgradeResult(config *Config, result UpgradeResult) error {
+	r.results = append(r.results, result)
+	return nil
+}
+
+func TestPackageDrift(t *testing.T) {
+	installed := parseInstalledPackages(`auditd amd64 1:3.0.7-1.1 ii
+telnet amd64 0.17+2.4-2 ii
+libc6 amd64 2.36-9+deb12u4 ii
+nano amd64 7.2-1 rc
+`)
+	config := &PackagesConfig{
+		MustHave:    []string{"chrony", "auditd", "libc6:i386", "nano"},
+		MustNotHave: []string{"telnet", "rsh-client", "libc6:amd64"},
+	}
+
+	drift := packageDrift(config, installed)
+	expected := PackageDrift{
+		Missing:  []string{"chrony", "libc6:i386", "nano"},
+		Unwanted: []string{"libc6:amd64", "telnet"},
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("Unexpected drift: %+v, expected %+v", drift, expected)
+	}
+
+	if drift := packageDrift(&PackagesConfig{MustHave: []string{"auditd"}}, installed); !drift.empty() {
+		t.Errorf("Expected no drift, got %+v", drift)
+	}
+}
+
+func TestValidatePackageChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		operation  string
+		names      []string
+		privileged bool
+		wantErr    string
+	}{
+		{"Install", OperationInstall, []string{"chrony", "libc6:i386", "g++", "libsss_certmap"}, true, ""},
+		{"Unsupported operation", OperationEnforce, []string{"chrony"}, true, "unsupported package operation"},
+		{"No packages", OperationRemove, nil, true, "without packages"},
+		{"Option as a name", OperationInstall, []string{"--allow-downgrades"}, true, "invalid package name"},
+		{"Unprivileged", OperationInstall, []string{"chrony"}, false, "needs the agent to run as root"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePackageChange(tt.operation, tt.names, tt.privileged)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validatePackageChange() error = %v, expected %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunInstructedPackageChange(t *testing.T) {
+	config := &Config{StateDir: t.TempDir(), Hostname: "FunkyPenguin"}
+	reporter := &recordingResultReporter{}
+
+	instruction := &Instruction{ID: "install-1", Action: ActionInstall, Packages: []string{"-oAPT::Get::Force=1"}}
+	if _, err := runInstructedPackageChange(config, instruction, reporter); err == nil || !strings.Contains(err.Error(), "invalid package name") {
+		t.Errorf("expected the package name to be rejected, got %v", err)
+	}
+
+	if len(reporter.results) != 1 {
+		t.Fatalf("expected one reported result, got %d", len(reporter.results))
+	}
+	result := reporter.results[0]
+	if result.Success || result.InstructionID != "install-1" || result.Trigger != UpgradeTriggerBackend || result.Operation != OperationInstall {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if history, err := readHistory(config.StateDir, time.Time{}); err != nil || len(history) != 1 || history[0].ID != result.ID {
+		t.Errorf("expected the rejected change in the history, got %+v, %v", history, err)
+	}
+}
+
+func TestRemediatePackages(t *testing.T) {
+	// apt-get only has to exist; dpkg-query reports chrony as not installed.
+	// The package manager itself is not in PATH, so the change fails.
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"apt-get":    "#!/bin/sh\nexit 1\n",
+		"dpkg-query": "#!/bin/sh\necho 'auditd amd64 1:3.0.7-1.1 ii'\necho 'telnet amd64 0.17+2.4-2 ii'\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+
+	config := &Config{StateDir: t.TempDir(), Packages: PackagesConfig{MustHave: []string{"auditd"}, MustNotHave: []string{"rsh-client"}}}
+	reporter := &recordingResultReporter{}
+
+	remediatePackages(config, reporter)
+	if len(reporter.results) != 0 {
+		t.Errorf("expected no remediation without drift, got %+v", reporter.results)
+	}
+
+	config.Packages.MustHave = append(config.Packages.MustHave, "chrony")
+	remediatePackages(config, reporter)
+	if len(reporter.results) != 1 {
+		t.Fatalf("expected one remediation result, got %d", len(reporter.results))
+	}
+	result := reporter.results[0]
+	if result.Trigger != UpgradeTriggerRemediation || result.Operation != OperationEnforce || result.Success || result.Error == "" {
+		t.Errorf("unexpected remediation result %+v", result)
+	}
+}
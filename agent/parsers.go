@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Parsers for package manager output. They never fail: lines that look like
+// package rows but cannot be parsed are skipped and returned as warnings.
+// Captured outputs are in testdata/.
+
+var (
+	// Inst NAME [OLD_VERSION] (NEW_VERSION SUITES [ARCH]); OLD_VERSION is absent for new installs
+	aptSimInstRegexp = regexp.MustCompile(`^Inst\s+(\S+)(?:\s+\[([^\]]*)\])?\s+\((\S+)\s+(.*?)\s*\[([^\]]+)\]\)`)
+	// Remv NAME [OLD_VERSION] or Purg NAME [OLD_VERSION]
+	aptSimRemvRegexp = regexp.MustCompile(`^(?:Remv|Purg)\s+(\S+)(?:\s+\[([^\]]*)\])?`)
+	// Conf NAME (VERSION SUITES [ARCH])
+	aptSimConfRegexp = regexp.MustCompile(`^Conf\s+\S+`)
+	// the actions apt-get -s prints, one package per line
+	aptSimActionRegexp = regexp.MustCompile(`^(Inst|Remv|Purg|Conf)\s`)
+)
+
+// parseAptSimulation parses the output of apt-get -s
+func parseAptSimulation(output string) (*UpgradePlan, []string) {
+	plan := &UpgradePlan{PackageManager: "apt-get"}
+	var warnings []string
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := aptSimInstRegexp.FindStringSubmatch(line); m != nil {
+			name, arch := splitAptArch(m[1], m[5])
+			pkg := PackageInfo{
+				Name:       name,
+				Version:    m[2],
+				NewVersion: m[3],
+				Category:   m[4],
+				Arch:       arch,
+			}
+			if pkg.Version == "" {
+				plan.Installs = append(plan.Installs, pkg)
+			} else {
+				plan.Upgrades = append(plan.Upgrades, pkg)
+			}
+			continue
+		}
+		if m := aptSimRemvRegexp.FindStringSubmatch(line); m != nil {
+			name, arch := splitAptArch(m[1], "")
+			plan.Removals = append(plan.Removals, PackageInfo{
+				Name:    name,
+				Version: m[2],
+				Arch:    arch,
+			})
+			continue
+		}
+		// Conf lines configure the packages unpacked by the Inst lines
+		if aptSimActionRegexp.MatchString(line) && !aptSimConfRegexp.MatchString(line) {
+			warnings = append(warnings, fmt.Sprintf("unrecognized apt line: %q", line))
+		}
+	}
+
+	return plan, warnings
+}
+
+// splitAptArch splits a multi-arch qualified name like libc6:i386. A
+// qualifier of "all" or one matching arch is dropped.
+func splitAptArch(name, arch string) (string, string) {
+	base, qualifier, ok := strings.Cut(name, ":")
+	if !ok {
+		return name, arch
+	}
+	if arch == "" || arch == "all" {
+		arch = qualifier
+	}
+	return base, arch
+}
+
+// parseAptGetOutput parses apt-get -s upgrade into the upgradable packages
+func parseAptGetOutput(output string) ([]PackageInfo, []string) {
+	// raw string: Inst libpulse-dev [1:15.99.1+dfsg1-1ubuntu2] (1:15.99.1+dfsg1-1ubuntu2.1 Ubuntu:22.04/jammy-updates [amd64]) []
+	// format: STATUS NAME [VERSION] (NEW_VERSION CATEGORY [ARCHITECTURES]) [OTHER_INFO]
+	plan, warnings := parseAptSimulation(output)
+	return append(plan.Upgrades, plan.Installs...), warnings
+}
+
+// parseAptPrintURIsSize sums the sizes in lines like
+// 'http://archive.ubuntu.com/.../curl_7.81.0-1ubuntu1.16_amd64.deb' curl_7.81.0-1ubuntu1.16_amd64.deb 194582 SHA512:...
+func parseAptPrintURIsSize(output string) int64 {
+	var total int64
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 3 || !strings.HasPrefix(parts[0], "'") {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err == nil {
+			total += size
+		}
+	}
+	return total
+}
+
+// splitRPMArch splits NAME.ARCH as printed by dnf and yum
+func splitRPMArch(s string) (string, string, bool) {
+	for _, arch := range rpmArchs {
+		if name, ok := strings.CutSuffix(s, arch); ok && name != "" {
+			return name, arch[1:], true
+		}
+	}
+	return "", "", false
+}
+
+// looksLikeRPMVersion accepts [EPOCH:]VERSION[-RELEASE] starting with a digit
+func looksLikeRPMVersion(s string) bool {
+	_, v, ok := strings.Cut(s, ":")
+	if !ok {
+		v = s
+	}
+	return v != "" && v[0] >= '0' && v[0] <= '9'
+}
+
+// parseDnfYumOutput parses dnf/yum check-update. Rows are NAME.ARCH VERSION
+// REPO; a long NAME.ARCH is printed alone with the rest on the next line.
+// The "Obsoleting Packages" section lists packages replacing installed ones,
+// each followed by an indented row naming the installed package it replaces,
+// which is skipped; packages already listed as updates are reported once.
+// Metadata and plugin messages are ignored.
+func parseDnfYumOutput(output string) ([]PackageInfo, []string) {
+	var packages []PackageInfo
+	var warnings []string
+
+	listed := make(map[string]bool) // NAME.ARCH
+	obsoleting := false
+	var pending []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "Obsoleting Packages" {
+			obsoleting = true
+			continue
+		}
+
+		fields := strings.Fields(line)
+		indented := strings.HasPrefix(line, " ")
+		if len(pending) > 0 {
+			if len(fields) > 0 && indented {
+				fields = append(pending, fields...)
+			} else {
+				warnings = append(warnings, fmt.Sprintf("incomplete dnf row: %q", strings.Join(pending, " ")))
+			}
+			pending = nil
+		} else if obsoleting && indented {
+			// the installed package replaced by the obsoleting package above
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		name, arch, ok := splitRPMArch(fields[0])
+		if !ok {
+			// e.g. "Last metadata expiration check: ..." or "Security: kernel-... is an installed security update"
+			continue
+		}
+		switch {
+		case len(fields) < 3 && !indented:
+			pending = fields
+		case len(fields) == 3 && looksLikeRPMVersion(fields[1]):
+			if listed[fields[0]] {
+				continue
+			}
+			listed[fields[0]] = true
+			packages = append(packages, PackageInfo{
+				Name:       name,
+				Arch:       arch,
+				NewVersion: fields[1],
+				Category:   fields[2],
+			})
+		default:
+			warnings = append(warnings, fmt.Sprintf("unrecognized dnf row: %q", line))
+		}
+	}
+	if len(pending) > 0 {
+		warnings = append(warnings, fmt.Sprintf("incomplete dnf row: %q", strings.Join(pending, " ")))
+	}
+
+	return packages, warnings
+}
+
+// parseDnfYumTransaction parses the transaction table printed before dnf/yum asks for confirmation
+func parseDnfYumTransaction(output string) (*UpgradePlan, []string) {
+	plan := &UpgradePlan{DownloadSize: -1}
+	var warnings []string
+
+	var section *[]PackageInfo
+	var wrapped []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "Total download size:") {
+			plan.DownloadSize = parseDnfSize(strings.TrimPrefix(trimmed, "Total download size:"))
+			continue
+		}
+
+		// section headers start in the first column, package rows are indented
+		if !strings.HasPrefix(line, " ") {
+			lower := strings.ToLower(trimmed)
+			switch {
+			case strings.Contains(lower, "module") || strings.Contains(lower, "group"):
+				// module streams and groups are listed by name, their packages have their own rows
+				section = nil
+			case trimmed == "Upgrading:" || trimmed == "Updating:" || strings.HasPrefix(trimmed, "Updating for dependencies"):
+				section = &plan.Upgrades
+			case strings.HasPrefix(trimmed, "Installing") && strings.HasSuffix(trimmed, ":"):
+				section = &plan.Installs
+			case strings.HasPrefix(trimmed, "Removing") && strings.HasSuffix(trimmed, ":"):
+				section = &plan.Removals
+			case strings.HasSuffix(trimmed, ":") || trimmed == "Transaction Summary":
+				// Downgrading:, Reinstalling: and the summary are not part of the plan
+				section = nil
+			}
+			wrapped = nil
+			continue
+		}
+
+		if section == nil {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		// "replacing  NAME.ARCH VERSION" follows a package that obsoletes an installed one
+		if len(parts) > 0 && parts[0] == "replacing" {
+			continue
+		}
+		// long package names are printed alone, with the rest of the row on the next line
+		if wrapped != nil {
+			parts = append(wrapped, parts...)
+			wrapped = nil
+		}
+		if len(parts) < 4 {
+			wrapped = parts
+			continue
+		}
+		// NAME ARCH VERSION REPO SIZE UNIT; yum prints SIZE with its unit attached
+		if len(parts) > 6 || !looksLikeRPMVersion(parts[2]) {
+			warnings = append(warnings, fmt.Sprintf("unrecognized dnf transaction row: %q", trimmed))
+			continue
+		}
+
+		pkg := PackageInfo{
+			Name:     parts[0],
+			Arch:     parts[1],
+			Category: parts[3],
+		}
+		if section == &plan.Removals {
+			pkg.Version = parts[2]
+		} else {
+			pkg.NewVersion = parts[2]
+		}
+		*section = append(*section, pkg)
+	}
+	if wrapped != nil {
+		warnings = append(warnings, fmt.Sprintf("incomplete dnf transaction row: %q", strings.Join(wrapped, " ")))
+	}
+
+	return plan, warnings
+}
+
+// parseDnfSize parses sizes like "18 M" or "294 k" into bytes
+func parseDnfSize(s string) int64 {
+	parts := strings.Fields(s)
+	if len(parts) == 0 {
+		return -1
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return -1
+	}
+
+	multiplier := float64(1)
+	if len(parts) > 1 {
+		switch strings.ToLower(parts[1]) {
+		case "k":
+			multiplier = 1024
+		case "m":
+			multiplier = 1024 * 1024
+		case "g":
+			multiplier = 1024 * 1024 * 1024
+		}
+	}
+	return int64(value * multiplier)
+}
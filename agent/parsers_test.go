@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func packageNames(packages []PackageInfo) []string {
+	var names []string
+	for _, pkg := range packages {
+		names = append(names, pkg.Name+"/"+pkg.Arch)
+	}
+	return names
+}
+
+func TestParseAptFixtures(t *testing.T) {
+	plan, warnings := parseAptSimulation(readTestdata(t, "apt-get-upgrade-jammy.txt"))
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if len(plan.Upgrades) != 7 || len(plan.Installs) != 4 || len(plan.Removals) != 0 {
+		t.Fatalf("unexpected plan: upgrades %v, installs %v, removals %v", packageNames(plan.Upgrades), packageNames(plan.Installs), packageNames(plan.Removals))
+	}
+	libc := plan.Upgrades[1]
+	if libc.Name != "libc6" || libc.Arch != "i386" || libc.Version != "2.35-0ubuntu3.6" || libc.NewVersion != "2.35-0ubuntu3.7" {
+		t.Errorf("unexpected multi-arch package: %+v", libc)
+	}
+	if plan.Upgrades[0].Category != "Ubuntu:22.04/jammy-updates, Ubuntu:22.04/jammy-security" {
+		t.Errorf("unexpected suites: %q", plan.Upgrades[0].Category)
+	}
+	if plan.Installs[0].Name != "linux-modules-5.15.0-101-generic" || plan.Installs[0].Version != "" || plan.Installs[0].NewVersion != "5.15.0-101.111" {
+		t.Errorf("unexpected new install: %+v", plan.Installs[0])
+	}
+
+	packages, _ := parseAptGetOutput(readTestdata(t, "apt-get-upgrade-jammy.txt"))
+	if len(packages) != 11 {
+		t.Errorf("expected upgrades and new installs, got %v", packageNames(packages))
+	}
+
+	plan, warnings = parseAptSimulation(readTestdata(t, "apt-get-dist-upgrade-bookworm.txt"))
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if len(plan.Upgrades) != 3 || len(plan.Installs) != 1 {
+		t.Errorf("unexpected plan: upgrades %v, installs %v", packageNames(plan.Upgrades), packageNames(plan.Installs))
+	}
+	if len(plan.Removals) != 2 || plan.Removals[0].Name != "linux-image-6.1.0-17-amd64" || plan.Removals[1].Version != "0.17+2.4-2+deb12u1" {
+		t.Errorf("unexpected removals: %+v", plan.Removals)
+	}
+}
+
+func TestParseDnfYumFixtures(t *testing.T) {
+	packages, warnings := parseDnfYumOutput(readTestdata(t, "dnf-check-update-el9.txt"))
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	// grub2-tools is listed in both sections, grub2-tools-efi only as obsoleting
+	if len(packages) != 11 {
+		t.Fatalf("unexpected packages: %v", packageNames(packages))
+	}
+	if packages[1].Name != "glibc" || packages[1].Arch != "i686" {
+		t.Errorf("unexpected package: %+v", packages[1])
+	}
+	if packages[6].Name != "grub2-tools" || packages[6].Arch != "x86_64" || packages[6].NewVersion != "1:2.06-70.el9_3.2" || packages[6].Category != "baseos" {
+		t.Errorf("unexpected package: %+v", packages[6])
+	}
+	if packages[10].Name != "grub2-tools-efi" || packages[10].NewVersion != "1:2.06-70.el9_3.2" || packages[10].Category != "baseos" {
+		t.Errorf("unexpected obsoleting package: %+v", packages[10])
+	}
+
+	packages, warnings = parseDnfYumOutput(readTestdata(t, "yum-check-update-el7.txt"))
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if len(packages) != 8 || packages[0].Name != "bind-export-libs" || packages[0].NewVersion != "32:9.11.4-26.P2.el7_9.15" {
+		t.Errorf("unexpected packages: %+v", packages)
+	}
+
+	plan, warnings := parseDnfYumTransaction(readTestdata(t, "dnf-upgrade-assumeno-el9.txt"))
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+	if len(plan.Upgrades) != 3 || len(plan.Installs) != 4 || len(plan.Removals) != 2 {
+		t.Errorf("unexpected plan: upgrades %v, installs %v, removals %v", packageNames(plan.Upgrades), packageNames(plan.Installs), packageNames(plan.Removals))
+	}
+	if plan.Installs[1].Name != "grub2-tools-efi" || plan.Installs[1].NewVersion != "1:2.06-70.el9_3.2" {
+		t.Errorf("unexpected obsoleting package: %+v", plan.Installs[1])
+	}
+	if plan.DownloadSize != 61*1024*1024 {
+		t.Errorf("DownloadSize = %d, want %d", plan.DownloadSize, 61*1024*1024)
+	}
+}
+
+func TestParseAptTruncated(t *testing.T) {
+	output := `Inst curl [7.88.1-10+deb12u4] (7.88.1-10+deb12u5 Debian:12.5/stable [amd64])
+Inst firmware-misc-nonfree
+`
+	plan, warnings := parseAptSimulation(output)
+	if len(plan.Upgrades) != 1 || len(warnings) != 1 {
+		t.Errorf("expected the complete row and a warning for the truncated one, got %v, %v", packageNames(plan.Upgrades), warnings)
+	}
+}
+
+func TestParseDnfYumRows(t *testing.T) {
+	output := `Security: kernel-core-5.14.0-362.18.1.el9_3.x86_64 is an installed security update
+libcurl.x86_64                     7.76.1-26.el9_3.3                   baseos
+a-package-with-a-very-long-name-for-the-column.noarch
+                                   1.2-3.el9                           appstream
+broken-row.x86_64                  baseos
+Obsoleting Packages
+another-package-with-a-long-name.x86_64
+                                   2.0-1.el9                           appstream
+    old-package.x86_64             1.0-1.el9                           @appstream
+`
+	packages, warnings := parseDnfYumOutput(output)
+	if got := packageNames(packages); len(got) != 3 || got[1] != "a-package-with-a-very-long-name-for-the-column/noarch" || got[2] != "another-package-with-a-long-name/x86_64" {
+		t.Errorf("unexpected packages: %v", got)
+	}
+	if len(packages) == 3 && (packages[1].NewVersion != "1.2-3.el9" || packages[2].Category != "appstream") {
+		t.Errorf("unexpected wrapped packages: %+v", packages[1:])
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected a warning for the broken row, got %v", warnings)
+	}
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// UpgradePlan is what an upgrade would change, computed with the package
+// manager's simulation mode without changing the system
+type UpgradePlan struct {
+	PackageManager string        `json:"package_manager"`
+	Upgrades       []PackageInfo `json:"upgrades"`
+	Installs       []PackageInfo `json:"installs"` // new dependencies
+	Removals       []PackageInfo `json:"removals"`
+	DownloadSize   int64         `json:"download_size"`      // bytes, -1 if unknown
+	Warnings       []string      `json:"warnings,omitempty"` // output lines that could not be parsed
+}
+
+func planUpgrade() (*UpgradePlan, error) {
+	pm, err := getPackageManager()
+	if err != nil {
+		return nil, err
+	}
+
+	var plan *UpgradePlan
+	switch pm {
+	case "apt-get":
+		plan, err = planAptUpgrade()
+	case "dnf", "yum":
+		plan, err = planDnfYumUpgrade(pm)
+	default:
+		return nil, fmt.Errorf("unsupported package manager")
+	}
+	if err != nil {
+		return nil, err
+	}
+	setUpdateTypes(pm, plan.Upgrades)
+	return plan, nil
+}
+
+func planAptUpgrade() (*UpgradePlan, error) {
+	out, err := exec.Command("apt-get", "-s", "upgrade").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to simulate upgrade: %v", err)
+	}
+	plan, warnings := parseAptSimulation(string(out))
+	plan.Warnings = warnings
+
+	// --print-uris lists what would be downloaded, with sizes, without downloading it
+	plan.DownloadSize = -1
+	out, err = exec.Command("apt-get", "--print-uris", "-qq", "upgrade").Output()
+	if err == nil {
+		plan.DownloadSize = parseAptPrintURIsSize(string(out))
+	}
+
+	return plan, nil
+}
+
+func planDnfYumUpgrade(pm string) (*UpgradePlan, error) {
+	// dnf refuses to resolve an upgrade transaction for unprivileged users, even with --assumeno
+	cmd := privilegedCommand(pm, "upgrade", "--assumeno")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	// answering "no" makes dnf exit with status 1
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return nil, fmt.Errorf("failed to simulate upgrade: %v", err)
+	}
+
+	plan, warnings := parseDnfYumTransaction(stdout.String())
+	plan.Warnings = warnings
+	plan.PackageManager = pm
+	fillInstalledRPMVersions(plan.Upgrades)
+	return plan, nil
+}
+
+// fillInstalledRPMVersions sets Version from the rpm database, since the
+// dnf/yum transaction table only shows the version being installed
+func fillInstalledRPMVersions(packages []PackageInfo) {
+	if len(packages) == 0 {
+		return
+	}
+
+	// with the epoch, like the new versions dnf and yum print
+	args := []string{"-q", "--qf", "%{NAME}.%{ARCH} %{EPOCHNUM}:%{VERSION}-%{RELEASE}\n"}
+	for _, pkg := range packages {
+		args = append(args, pkg.Name+"."+pkg.Arch)
+	}
+	// rpm exits non-zero if any package is missing but still prints the others
+	out, _ := exec.Command("rpm", args...).Output()
+
+	installed := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 2 {
+			installed[parts[0]] = strings.TrimPrefix(parts[1], "0:")
+		}
+	}
+	for i := range packages {
+		packages[i].Version = installed[packages[i].Name+"."+packages[i].Arch]
+	}
+}
+
+// privilegedCommand runs name through non-interactive sudo unless already root
+func privilegedCommand(name string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("sudo", append([]string{"-n", "--", name}, args...)...)
+}
+
+func printUpgradePlan(plan *UpgradePlan) {
+	fmt.Printf("Upgrade plan (%s):\n", plan.PackageManager)
+
+	fmt.Printf("- %d package(s) to upgrade\n", len(plan.Upgrades))
+	for _, pkg := range plan.Upgrades {
+		if pkg.UpdateType != "" {
+			fmt.Printf("  - %s: %s -> %s (%s)\n", pkg.Name, pkg.Version, pkg.NewVersion, pkg.UpdateType)
+		} else {
+			fmt.Printf("  - %s: %s -> %s\n", pkg.Name, pkg.Version, pkg.NewVersion)
+		}
+	}
+	fmt.Printf("- %d new package(s) to install\n", len(plan.Installs))
+	for _, pkg := range plan.Installs {
+		fmt.Printf("  - %s: %s\n", pkg.Name, pkg.NewVersion)
+	}
+	fmt.Printf("- %d package(s) to remove\n", len(plan.Removals))
+	for _, pkg := range plan.Removals {
+		fmt.Printf("  - %s: %s\n", pkg.Name, pkg.Version)
+	}
+
+	for _, warning := range plan.Warnings {
+		fmt.Printf("- Warning: %s\n", warning)
+	}
+
+	if plan.DownloadSize >= 0 {
+		fmt.Printf("- Download size: %.1f MB\n", float64(plan.DownloadSize)/(1024*1024))
+	} else {
+		fmt.Println("- Download size: unknown")
+	}
+}
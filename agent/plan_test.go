@@ -0,0 +1,89 @@
+package agent
+
+import "testing"
+
+func TestParseAptSimulation(t *testing.T) {
+	output := `Reading package lists...
+Building dependency tree...
+The following packages will be upgraded:
+  libpulse-dev linux-generic
+Inst libpulse-dev [1:15.99.1+dfsg1-1ubuntu2] (1:15.99.1+dfsg1-1ubuntu2.1 Ubuntu:22.04/jammy-updates [amd64]) []
+Inst linux-image-5.15.0-100-generic (5.15.0-100.110 Ubuntu:22.04/jammy-updates, Ubuntu:22.04/jammy-security [amd64])
+Remv linux-image-5.15.0-90-generic [5.15.0-90.100]
+Conf libpulse-dev (1:15.99.1+dfsg1-1ubuntu2.1 Ubuntu:22.04/jammy-updates [amd64])
+`
+	plan, warnings := parseAptSimulation(output)
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	if len(plan.Upgrades) != 1 || plan.Upgrades[0].Name != "libpulse-dev" || plan.Upgrades[0].Version != "1:15.99.1+dfsg1-1ubuntu2" || plan.Upgrades[0].NewVersion != "1:15.99.1+dfsg1-1ubuntu2.1" {
+		t.Errorf("unexpected upgrades: %+v", plan.Upgrades)
+	}
+	if len(plan.Installs) != 1 || plan.Installs[0].Name != "linux-image-5.15.0-100-generic" || plan.Installs[0].Arch != "amd64" {
+		t.Errorf("unexpected installs: %+v", plan.Installs)
+	}
+	if len(plan.Removals) != 1 || plan.Removals[0].Version != "5.15.0-90.100" {
+		t.Errorf("unexpected removals: %+v", plan.Removals)
+	}
+}
+
+func TestParseDnfYumTransaction(t *testing.T) {
+	output := `Dependencies resolved.
+================================================================================
+ Package                      Arch    Version                 Repository   Size
+================================================================================
+Upgrading:
+ curl                         x86_64  7.76.1-26.el9_3.2       baseos      294 k
+ python3-setuptools-wheel-with-a-very-long-name
+                              noarch  53.0.0-12.el9_3.1       baseos      467 k
+Installing dependencies:
+ kernel-core                  x86_64  5.14.0-362.18.1.el9_3   baseos       17 M
+Removing:
+ kernel-core                  x86_64  5.14.0-284.11.1.el9_2   @baseos      62 M
+
+Transaction Summary
+================================================================================
+Install  1 Package
+Upgrade  2 Packages
+Remove   1 Package
+
+Total download size: 18 M
+Operation aborted.
+`
+	plan, warnings := parseDnfYumTransaction(output)
+	if len(warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+
+	if len(plan.Upgrades) != 2 || plan.Upgrades[1].Name != "python3-setuptools-wheel-with-a-very-long-name" || plan.Upgrades[1].NewVersion != "53.0.0-12.el9_3.1" {
+		t.Errorf("unexpected upgrades: %+v", plan.Upgrades)
+	}
+	if len(plan.Installs) != 1 || plan.Installs[0].NewVersion != "5.14.0-362.18.1.el9_3" {
+		t.Errorf("unexpected installs: %+v", plan.Installs)
+	}
+	if len(plan.Removals) != 1 || plan.Removals[0].Version != "5.14.0-284.11.1.el9_2" {
+		t.Errorf("unexpected removals: %+v", plan.Removals)
+	}
+	if plan.DownloadSize != 18*1024*1024 {
+		t.Errorf("DownloadSize = %d, want %d", plan.DownloadSize, 18*1024*1024)
+	}
+}
+
+func TestSetUpdateTypes(t *testing.T) {
+	packages := []PackageInfo{
+		{Name: "libpulse-dev", Version: "1:15.99.1+dfsg1-1ubuntu2", NewVersion: "1:15.99.1+dfsg1-1ubuntu2.1"},
+		{Name: "nodejs", Version: "18.19.1-1nodesource1", NewVersion: "20.11.1-1nodesource1"},
+		{Name: "linux-image-generic", NewVersion: "5.15.0.100.97"},
+	}
+	setUpdateTypes("apt-get", packages)
+	if packages[0].UpdateType != "patch" || packages[1].UpdateType != "major" || packages[2].UpdateType != "" {
+		t.Errorf("unexpected update types: %+v", packages)
+	}
+
+	packages = []PackageInfo{{Name: "openssl", Version: "1:3.0.7-24.el9", NewVersion: "1:3.2.2-6.el9_5"}}
+	setUpdateTypes("dnf", packages)
+	if packages[0].UpdateType != "minor" {
+		t.Errorf("unexpected update type: %+v", packages[0])
+	}
+}
@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/shirou/gopsutil/host"
+)
+
+// Reboot policies
+const (
+	RebootNever             = "never"
+	RebootIfRequired        = "if_required"
+	RebootMaintenanceWindow = "maintenance_window"
+)
+
+const rebootRequiredFile = "/var/run/reboot-required"
+
+// how long past its warning period a scheduled reboot may take before the
+// daemon considers it cancelled and schedules it again
+const rebootGracePeriod = 15 * time.Minute
+
+// needs-restarting queries the rpm database on every run, which is too slow
+// for each telemetry poll. Its verdict only changes when packages do, so it is
+// cached until the agent changes packages, or for needsRestartingMaxAge to
+// catch changes made by others.
+const needsRestartingMaxAge = time.Hour
+
+var needsRestarting struct {
+	sync.Mutex
+	checked  time.Time
+	required bool
+}
+
+// needsRestartingReboot reports whether needs-restarting -r asks for a reboot
+func needsRestartingReboot() bool {
+	needsRestarting.Lock()
+	defer needsRestarting.Unlock()
+
+	if time.Since(needsRestarting.checked) < needsRestartingMaxAge {
+		return needsRestarting.required
+	}
+	err := exec.Command("needs-restarting", "-r").Run()
+	var exitErr *exec.ExitError
+	needsRestarting.required = errors.As(err, &exitErr) && exitErr.ExitCode() == 1
+	needsRestarting.checked = time.Now()
+	return needsRestarting.required
+}
+
+// invalidateRebootStatus makes the next check run needs-restarting again,
+// after packages changed
+func invalidateRebootStatus() {
+	needsRestarting.Lock()
+	needsRestarting.checked = time.Time{}
+	needsRestarting.Unlock()
+}
+
+// RebootStatus tells whether the host runs outdated code that only a reboot replaces
+type RebootStatus struct {
+	Required        bool     `json:"required"`
+	Reasons         []string `json:"reasons,omitempty"`
+	Packages        []string `json:"packages,omitempty"` // packages that asked for the reboot, if known
+	RunningKernel   string   `json:"running_kernel,omitempty"`
+	InstalledKernel string   `json:"installed_kernel,omitempty"` // newest installed kernel
+}
+
+// detectRebootRequired combines the distribution's own signals with a
+// comparison of the running kernel against the newest installed one
+func detectRebootRequired() RebootStatus {
+	var status RebootStatus
+
+	// Debian and Ubuntu: written by package postinst scripts
+	if _, err := os.Stat(rebootRequiredFile); err == nil {
+		status.Reasons = append(status.Reasons, rebootRequiredFile+" exists")
+		if data, err := os.ReadFile(rebootRequiredFile + ".pkgs"); err == nil {
+			status.Packages = strings.Fields(string(data))
+		}
+	}
+
+	// RHEL, Fedora and derivatives: exits with status 1 when a reboot is needed
+	if _, err := exec.LookPath("needs-restarting"); err == nil && needsRestartingReboot() {
+		status.Reasons = append(status.Reasons, "needs-restarting -r reports a reboot is required")
+	}
+
+	running, err := host.KernelVersion()
+	if err == nil {
+		status.RunningKernel = running
+		status.InstalledKernel = newestInstalledKernel()
+		// containers and custom kernels have no matching image in /boot
+		if status.InstalledKernel != "" && compareKernelReleases(status.InstalledKernel, running) > 0 {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("running kernel %s, newest installed kernel %s", running, status.InstalledKernel))
+		}
+	}
+
+	status.Required = len(status.Reasons) > 0
+	return status
+}
+
+// newestInstalledKernel returns the release of the newest kernel image in /boot
+func newestInstalledKernel() string {
+	images, _ := filepath.Glob("/boot/vmlinuz-*")
+
+	var newest string
+	for _, image := range images {
+		release := strings.TrimPrefix(filepath.Base(image), "vmlinuz-")
+		// RHEL keeps a rescue image that is not a kernel update
+		if strings.HasPrefix(release, "0-rescue-") {
+			continue
+		}
+		if newest == "" || compareKernelReleases(release, newest) > 0 {
+			newest = release
+		}
+	}
+	return newest
+}
+
+// compareKernelReleases compares kernel releases like 5.15.0-91-generic or
+// 5.14.0-362.8.1.el9_3.x86_64 by their numeric components
+func compareKernelReleases(a, b string) int {
+	isSeparator := func(r rune) bool { return !unicode.IsDigit(r) }
+	aParts, bParts := strings.FieldsFunc(a, isSeparator), strings.FieldsFunc(b, isSeparator)
+
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		x, _ := strconv.Atoi(aParts[i])
+		y, _ := strconv.Atoi(bParts[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+// MaintenanceWindow is a daily time range in local time, optionally limited
+// to some days of the week. A window whose end is before its start runs past
+// midnight and belongs to the day it starts on.
+type MaintenanceWindow struct {
+	Days  []time.Weekday // empty means every day
+	Start time.Duration  // since local midnight
+	End   time.Duration
+}
+
+// Contains reports whether t falls within the window
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+
+	if w.Start <= w.End {
+		if sinceMidnight < w.Start || sinceMidnight >= w.End {
+			return false
+		}
+	} else if sinceMidnight < w.End {
+		// the early part of a window that started the day before
+		day = (day + 6) % 7
+	} else if sinceMidnight < w.Start {
+		return false
+	}
+
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseMaintenanceWindow(days []string, start, end string) (MaintenanceWindow, error) {
+	var window MaintenanceWindow
+	for _, day := range days {
+		weekday, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+		if !ok {
+			return window, fmt.Errorf("invalid day %q", day)
+		}
+		window.Days = append(window.Days, weekday)
+	}
+
+	var err error
+	if window.Start, err = parseTimeOfDay(start); err != nil {
+		return window, err
+	}
+	if window.End, err = parseTimeOfDay(end); err != nil {
+		return window, err
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// rebootDue reports whether the policy allows rebooting now for status
+func rebootDue(config *RebootConfig, status RebootStatus, now time.Time) bool {
+	if !status.Required {
+		return false
+	}
+	switch config.Policy {
+	case RebootIfRequired:
+		return true
+	case RebootMaintenanceWindow:
+		// the reboot itself must also happen within the window
+		return config.Window.Contains(now) && config.Window.Contains(now.Add(config.Warning))
+	default:
+		return false
+	}
+}
+
+// scheduleReboot asks shutdown to reboot the host, giving logged-in users
+// config.Warning to save their work; shutdown broadcasts the message to them.
+// Without logged-in users the host reboots right away.
+func scheduleReboot(config *RebootConfig, status RebootStatus) error {
+	users, err := host.Users()
+	if err != nil {
+		return fmt.Errorf("failed to collect logged-in users: %v", err)
+	}
+	var loggedIn []string
+	for _, user := range users {
+		loggedIn = append(loggedIn, user.User)
+	}
+
+	when := "now"
+	if len(loggedIn) > 0 && config.Warning > 0 {
+		when = fmt.Sprintf("+%d", int(config.Warning.Minutes()))
+		log.Printf("Warning logged-in users %v of reboot in %s\n", loggedIn, config.Warning)
+	}
+
+	message := config.Message
+	if message == "" {
+		message = "RedT agent: rebooting to finish system upgrades (" + strings.Join(status.Reasons, "; ") + ")"
+	}
+
+	out, err := privilegedCommand("shutdown", "-r", when, message).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to schedule reboot: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("Reboot scheduled (%s): %s\n", when, strings.Join(status.Reasons, "; "))
+	return nil
+}
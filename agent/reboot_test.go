@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompareKernelReleases(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"5.15.0-101-generic", "5.15.0-91-generic", 1},
+		{"5.15.0-91-generic", "5.15.0-91-generic", 0},
+		{"5.14.0-362.8.1.el9_3.x86_64", "5.14.0-362.13.1.el9_3.x86_64", -1},
+		{"6.1.0-18-amd64", "5.10.0-28-amd64", 1},
+	}
+	for _, test := range tests {
+		got := compareKernelReleases(test.a, test.b)
+		if (got > 0) != (test.want > 0) || (got < 0) != (test.want < 0) {
+			t.Errorf("compareKernelReleases(%q, %q) = %d, want sign of %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	// Saturday 23:00 to Sunday 01:00
+	window, err := parseMaintenanceWindow([]string{"Sat"}, "23:00", "01:00")
+	if err != nil {
+		t.Fatalf("Failed to parse window: %v", err)
+	}
+
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2024, 3, 16, 23, 30, 0, 0, time.Local), true},  // Saturday
+		{time.Date(2024, 3, 17, 0, 30, 0, 0, time.Local), true},   // early Sunday, started Saturday
+		{time.Date(2024, 3, 17, 23, 30, 0, 0, time.Local), false}, // Sunday evening
+		{time.Date(2024, 3, 16, 0, 30, 0, 0, time.Local), false},  // early Saturday, started Friday
+		{time.Date(2024, 3, 16, 12, 0, 0, 0, time.Local), false},
+	}
+	for _, test := range tests {
+		if got := window.Contains(test.at); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.at.Format(time.RFC1123), got, test.want)
+		}
+	}
+
+	if _, err := parseMaintenanceWindow([]string{"someday"}, "02:00", "04:00"); err == nil {
+		t.Error("Expected error for invalid day")
+	}
+	if _, err := parseMaintenanceWindow(nil, "2am", "04:00"); err == nil {
+		t.Error("Expected error for invalid time")
+	}
+}
+
+func TestRebootDue(t *testing.T) {
+	now := time.Date(2024, 3, 16, 3, 0, 0, 0, time.Local)
+	required := RebootStatus{Required: true}
+	window := MaintenanceWindow{Start: 2 * time.Hour, End: 4 * time.Hour}
+
+	if rebootDue(&RebootConfig{Policy: RebootIfRequired}, RebootStatus{}, now) {
+		t.Error("Expected no reboot when none is required")
+	}
+	if rebootDue(&RebootConfig{Policy: RebootNever}, required, now) {
+		t.Error("Expected no reboot with policy never")
+	}
+	if !rebootDue(&RebootConfig{Policy: RebootMaintenanceWindow, Window: window, Warning: 10 * time.Minute}, required, now) {
+		t.Error("Expected reboot within the maintenance window")
+	}
+	if rebootDue(&RebootConfig{Policy: RebootMaintenanceWindow, Window: window, Warning: 90 * time.Minute}, required, now) {
+		t.Error("Expected no reboot when the warning would end after the window")
+	}
+}
+
+func TestNeedsRestartingCached(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho run >> " + calls + "\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "needs-restarting"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	invalidateRebootStatus()
+	t.Cleanup(invalidateRebootStatus)
+
+	countCalls := func() int {
+		data, _ := os.ReadFile(calls)
+		return len(data) / len("run\n")
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := detectRebootRequired(); !status.Required {
+			t.Fatalf("expected needs-restarting to require a reboot, got %+v", status)
+		}
+	}
+	if n := countCalls(); n != 1 {
+		t.Errorf("expected needs-restarting to run once between package changes, ran %d times", n)
+	}
+
+	// changing packages drops the cached verdict
+	recordChanges(&Config{}, &UpgradeResult{}, func() error { return nil })
+	detectRebootRequired()
+	if n := countCalls(); n != 2 {
+		t.Errorf("expected needs-restarting to run again after a package change, ran %d times", n)
+	}
+}
+
+func TestCheckRebootClearsScheduled(t *testing.T) {
+	if detectRebootRequired().Required {
+		t.Skip("this host requires a reboot")
+	}
+	d := &daemon{
+		config:            &Config{Reboot: RebootConfig{Policy: RebootIfRequired}},
+		rebootScheduledAt: time.Now(),
+	}
+	d.checkReboot()
+	if !d.rebootScheduledAt.IsZero() {
+		t.Error("expected the scheduled reboot to be cleared once no reboot is required")
+	}
+}
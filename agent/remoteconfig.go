@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
+)
+
+const remoteConfigFile = "remote-config.json"
+
+// RemoteConfig is a configuration overlay served by the backend. Settings use
+// the same dotted keys as config.yml and are merged on top of the local file.
+type RemoteConfig struct {
+	Version  string                 `json:"version"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+// remotelySettable lists the only keys the backend may set, with their validation.
+// Anything that decides whom the agent trusts or talks to is deliberately absent.
+var remotelySettable = map[string]func(interface{}) error{
+	"poll_interval":          boundedInteger(1, 86400), // seconds, up to a day
+	"upgrade_check_period":   boundedInteger(1, 10080), // minutes, up to a week
+	"disk_usage.fstypes":     stringList,
+	"disk_usage.mountpoints": stringList,
+	"upload.compression":     oneOf(CompressionNone, CompressionGzip, CompressionZstd),
+	"upload.batch":           boolean,
+	"upload.max_batch":       boundedInteger(1, 10000),
+	"commands.enabled":       boolean,
+	"commands.wait":          boundedInteger(1, 3600), // seconds
+}
+
+// validateRemoteConfig rejects the whole overlay if any setting is unknown,
+// not remotely settable or of the wrong type
+func validateRemoteConfig(overlay *RemoteConfig) error {
+	if overlay.Version == "" {
+		return errors.New("remote config has no version")
+	}
+	for key, value := range overlay.Settings {
+		validate, ok := remotelySettable[key]
+		if !ok {
+			return fmt.Errorf("%s cannot be set remotely", key)
+		}
+		if err := validate(value); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// applyRemoteConfig merges the overlay into viper, skipping locally locked keys
+func applyRemoteConfig(overlay *RemoteConfig, locked []string) {
+	for key, value := range overlay.Settings {
+		if slices.Contains(locked, key) {
+			log.Printf("Ignoring remote setting %s: locked in local configuration", key)
+			continue
+		}
+		viper.Set(key, value)
+	}
+}
+
+// loadRemoteConfig returns the persisted overlay, or nil if none has been received
+func loadRemoteConfig(stateDir string) (*RemoteConfig, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, remoteConfigFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote config: %v", err)
+	}
+
+	var overlay RemoteConfig
+	if err := json.Unmarshal(data, &overlay); err != nil {
+		return nil, fmt.Errorf("failed to parse remote config: %v", err)
+	}
+	if err := validateRemoteConfig(&overlay); err != nil {
+		return nil, err
+	}
+	return &overlay, nil
+}
+
+// fetchRemoteConfig asks the backend for a newer overlay and persists it.
+// It reports whether the overlay changed, in which case the configuration
+// must be reloaded to take effect.
+func fetchRemoteConfig(config *Config) (bool, error) {
+	query := url.Values{"version": {config.RemoteConfigVersion}}
+	req, err := http.NewRequest("GET", config.RemoteConfigEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := doBackendRequest(config, req)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch remote config: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified, http.StatusNoContent:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return false, fmt.Errorf("failed to read remote config: %v", err)
+	}
+	var overlay RemoteConfig
+	if err := json.Unmarshal(data, &overlay); err != nil {
+		return false, fmt.Errorf("malformed remote config: %v", err)
+	}
+	if err := validateRemoteConfig(&overlay); err != nil {
+		return false, fmt.Errorf("rejected remote config: %v", err)
+	}
+	if overlay.Version == config.RemoteConfigVersion {
+		return false, nil
+	}
+
+	if err := writeStateFile(config.StateDir, remoteConfigFile, data); err != nil {
+		return false, fmt.Errorf("failed to save remote config: %v", err)
+	}
+	log.Printf("Received remote config version %s\n", overlay.Version)
+	return true, nil
+}
+
+// boundedInteger accepts whole numbers between min and max. Intervals are read
+// as whole seconds or minutes, so a fraction would truncate to a zero interval
+// and a huge value would overflow time.Duration into a negative one.
+func boundedInteger(min, max float64) func(interface{}) error {
+	return func(value interface{}) error {
+		number, ok := value.(float64)
+		if !ok || number < min || number > max || number != math.Trunc(number) {
+			return fmt.Errorf("expected an integer from %v to %v, got %v", min, max, value)
+		}
+		return nil
+	}
+}
+
+func boolean(value interface{}) error {
+	if _, ok := value.(bool); !ok {
+		return fmt.Errorf("expected a boolean, got %v", value)
+	}
+	return nil
+}
+
+func stringList(value interface{}) error {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("expected a list of strings, got %v", value)
+	}
+	for _, item := range list {
+		if _, ok := item.(string); !ok {
+			return fmt.Errorf("expected a list of strings, got %v", value)
+		}
+	}
+	return nil
+}
+
+func oneOf(allowed ...string) func(interface{}) error {
+	return func(value interface{}) error {
+		s, ok := value.(string)
+		if !ok || !slices.Contains(allowed, s) {
+			return fmt.Errorf("expected one of %q, got %v", allowed, value)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRemoteConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		overlay string
+		wantErr bool
+	}{
+		{"Allowed settings", `{"version":"3","settings":{"poll_interval":120,"disk_usage.mountpoints":["/","/srv"],"upload.compression":"zstd"}}`, false},
+		{"Missing version", `{"settings":{"poll_interval":120}}`, true},
+		{"Not remotely settable", `{"version":"3","settings":{"backend_url":"https://evil.example"}}`, true},
+		{"Wrong type", `{"version":"3","settings":{"poll_interval":"often"}}`, true},
+		{"Non-positive interval", `{"version":"3","settings":{"upgrade_check_period":0}}`, true},
+		{"Fractional interval", `{"version":"3","settings":{"poll_interval":0.5}}`, true},
+		{"Fractional wait", `{"version":"3","settings":{"commands.wait":1.5}}`, true},
+		{"Interval out of range", `{"version":"3","settings":{"poll_interval":1e10}}`, true},
+		{"Batch out of range", `{"version":"3","settings":{"upload.max_batch":100000}}`, true},
+		{"Unknown compression", `{"version":"3","settings":{"upload.compression":"brotli"}}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var overlay RemoteConfig
+			if err := json.Unmarshal([]byte(tt.overlay), &overlay); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateRemoteConfig(&overlay); (err != nil) != tt.wantErr {
+				t.Errorf("validateRemoteConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemoteConfigMerge(t *testing.T) {
+	overlay := `{"version":"7","settings":{"poll_interval":30,"upgrade_check_period":5,"disk_usage.fstypes":["xfs"],"upload.max_batch":10}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("version") == "7" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, overlay)
+	}))
+	defer server.Close()
+
+	stateDir := t.TempDir()
+	writeTestConfigFile(t, fmt.Sprintf(`backend_url: %q
+state_dir: %q
+poll_interval: 60
+upgrade_check_period: 60
+disk_usage:
+  fstypes: [ext4]
+remote_config:
+  enabled: true
+  locked: [upgrade_check_period]
+`, server.URL, stateDir))
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RemoteConfigEndpoint != server.URL+"/config" {
+		t.Fatalf("unexpected remote config endpoint %q", config.RemoteConfigEndpoint)
+	}
+	changed, err := fetchRemoteConfig(config)
+	if err != nil || !changed {
+		t.Fatalf("fetchRemoteConfig() = %v, %v", changed, err)
+	}
+	if info, err := os.Stat(filepath.Join(stateDir, remoteConfigFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the overlay to be persisted with mode 0600 (%v)", err)
+	}
+
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RemoteConfigVersion != "7" {
+		t.Errorf("expected remote config version 7, got %q", config.RemoteConfigVersion)
+	}
+	if config.PollInterval != 30*time.Second || config.Upload.MaxBatch != 10 {
+		t.Errorf("expected the overlay to override the local settings, got poll interval %v, max batch %d", config.PollInterval, config.Upload.MaxBatch)
+	}
+	if len(config.DiskUsage.FSTypes) != 1 || config.DiskUsage.FSTypes[0] != "xfs" {
+		t.Errorf("expected the overlay's fstypes, got %v", config.DiskUsage.FSTypes)
+	}
+	if config.UpgradeCheckPeriod != 60*time.Minute {
+		t.Errorf("expected the locked upgrade_check_period to keep its local value, got %v", config.UpgradeCheckPeriod)
+	}
+
+	if changed, err := fetchRemoteConfig(config); err != nil || changed {
+		t.Errorf("expected an unchanged overlay, got %v, %v", changed, err)
+	}
+}
+
+func TestRemoteConfigRejectsPersistedFraction(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := writeStateFile(stateDir, remoteConfigFile, []byte(`{"version":"8","settings":{"poll_interval":0.5}}`)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestConfigFile(t, fmt.Sprintf("state_dir: %q\npoll_interval: 60\nremote_config:\n  enabled: true\n", stateDir))
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PollInterval != 60*time.Second || config.RemoteConfigVersion != "" {
+		t.Errorf("expected the invalid overlay to be ignored, got poll interval %v, version %q", config.PollInterval, config.RemoteConfigVersion)
+	}
+}
+
+func TestLoadConfigRejectsNonPositiveInterval(t *testing.T) {
+	writeTestConfigFile(t, "poll_interval: -1\n")
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "poll_interval") {
+		t.Errorf("expected a negative poll_interval to be rejected, got %v", err)
+	}
+}
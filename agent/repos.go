@@ -0,0 +1,537 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Where package sources are configured
+const (
+	aptSourcesList = "/etc/apt/sources.list"
+	aptSourcesDir  = "/etc/apt/sources.list.d"
+	yumReposDir    = "/etc/yum.repos.d"
+)
+
+// Repository is a configured package source. Sources listing several URLs or
+// suites, like deb822 stanzas, are reported as one Repository for each.
+type Repository struct {
+	Type         string   `json:"type"`           // deb, deb-src, rpm or snap
+	Source       string   `json:"source"`         // the file configuring it, or "snap"
+	ID           string   `json:"id,omitempty"`   // yum/dnf repository ID, or snap name
+	Name         string   `json:"name,omitempty"` // yum/dnf repository name
+	Enabled      bool     `json:"enabled"`
+	URL          string   `json:"url,omitempty"` // for yum/dnf the first baseurl, else the mirrorlist or metalink
+	Suite        string   `json:"suite,omitempty"`
+	Components   []string `json:"components,omitempty"`
+	Channel      string   `json:"channel,omitempty"`   // the snap channel tracked
+	Publisher    string   `json:"publisher,omitempty"` // snap publisher
+	Keys         []string `json:"keys,omitempty"`      // signing key files or URLs
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	Unsigned     bool     `json:"unsigned,omitempty"` // signatures are not checked: apt trusted=yes, or gpgcheck=0
+}
+
+// listRepositories collects the package sources configured on the host.
+// Unreadable files and lines that cannot be parsed are logged and skipped.
+func listRepositories() []Repository {
+	var repos []Repository
+	var warnings []string
+	add := func(r []Repository, w []string) {
+		repos = append(repos, r...)
+		warnings = append(warnings, w...)
+	}
+
+	add(readSourceFiles(aptSourcesList, parseAptSourcesList))
+	add(readSourceFiles(filepath.Join(aptSourcesDir, "*.list"), parseAptSourcesList))
+	add(readSourceFiles(filepath.Join(aptSourcesDir, "*.sources"), parseDeb822Sources))
+	add(readSourceFiles(filepath.Join(yumReposDir, "*.repo"), parseRepoFile))
+
+	if _, err := exec.LookPath("snap"); err == nil {
+		out, err := exec.Command("snap", "list", "--unicode=never", "--color=never").Output()
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("snap list: %v", err))
+		} else {
+			repos = append(repos, parseSnapList(string(out))...)
+		}
+	}
+
+	warnings = append(warnings, resolveKeyFingerprints(repos)...)
+	for _, warning := range warnings {
+		log.Printf("Repository inventory: %s\n", warning)
+	}
+	return repos
+}
+
+func readSourceFiles(pattern string, parse func(path, content string) ([]Repository, []string)) ([]Repository, []string) {
+	paths, _ := filepath.Glob(pattern)
+	var repos []Repository
+	var warnings []string
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			warnings = append(warnings, err.Error())
+			continue
+		}
+		r, w := parse(path, string(data))
+		repos = append(repos, r...)
+		warnings = append(warnings, w...)
+	}
+	return repos, warnings
+}
+
+// parseAptSourcesList parses the one-line format of sources.list:
+// TYPE [OPTIONS] URI SUITE [COMPONENT...]. Lines commented out with "#" that
+// are otherwise valid are reported as disabled.
+func parseAptSourcesList(path, content string) ([]Repository, []string) {
+	var repos []Repository
+	var warnings []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		enabled := true
+		if strings.HasPrefix(line, "#") {
+			enabled = false
+			line = strings.TrimSpace(strings.TrimLeft(line, "#"))
+		}
+		fields := aptLineFields(line)
+		if len(fields) == 0 || (fields[0] != "deb" && fields[0] != "deb-src") {
+			continue
+		}
+
+		repo := Repository{Type: fields[0], Source: path, Enabled: enabled}
+		fields = fields[1:]
+		var options []string
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+			options = strings.Fields(strings.Trim(fields[0], "[]"))
+			fields = fields[1:]
+		}
+		if len(fields) < 2 || !strings.Contains(fields[0], ":") {
+			// commented-out prose that happens to start with "deb"
+			if enabled {
+				warnings = append(warnings, fmt.Sprintf("%s: incomplete source line: %q", path, line))
+			}
+			continue
+		}
+		repo.URL, repo.Suite, repo.Components = fields[0], fields[1], fields[2:]
+
+		for _, option := range options {
+			key, value, _ := strings.Cut(option, "=")
+			switch strings.TrimRight(key, "+-") {
+			case "signed-by":
+				setSignedBy(&repo, strings.Split(value, ","))
+			case "trusted":
+				repo.Unsigned = value == "yes"
+			}
+		}
+		repos = append(repos, repo)
+	}
+	return repos, warnings
+}
+
+// aptLineFields splits a sources.list line at whitespace outside brackets,
+// which enclose the options and cdrom URIs, and drops a trailing comment
+func aptLineFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	depth := 0
+	for _, c := range line {
+		if c == '#' && depth == 0 {
+			break
+		}
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ' ', '\t':
+			if depth == 0 {
+				if field.Len() > 0 {
+					fields = append(fields, field.String())
+					field.Reset()
+				}
+				continue
+			}
+		}
+		field.WriteRune(c)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// setSignedBy records the keys of an apt Signed-By value: keyring files, or
+// fingerprints of keys in the global keyrings
+func setSignedBy(repo *Repository, values []string) {
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+		case strings.HasPrefix(value, "/"):
+			repo.Keys = append(repo.Keys, value)
+		default:
+			// a trailing "!" pins a subkey
+			repo.Fingerprints = append(repo.Fingerprints, strings.ToUpper(strings.TrimSuffix(value, "!")))
+		}
+	}
+}
+
+// parseDeb822Sources parses a .sources file: stanzas of "Field: value" lines
+// separated by blank lines, values continued on indented lines, where " ."
+// stands for an empty line. Signed-By may embed an armored key.
+func parseDeb822Sources(path, content string) ([]Repository, []string) {
+	var repos []Repository
+	var warnings []string
+
+	stanza := make(map[string]string)
+	var field string
+	flush := func() {
+		if len(stanza) > 0 {
+			r, w := deb822Repositories(path, stanza)
+			repos = append(repos, r...)
+			warnings = append(warnings, w...)
+		}
+		stanza = make(map[string]string)
+		field = ""
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if field == "" {
+				warnings = append(warnings, fmt.Sprintf("%s: continuation line without a field: %q", path, line))
+				continue
+			}
+			value := strings.TrimSpace(line)
+			if value == "." {
+				value = ""
+			}
+			stanza[field] += "\n" + value
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: unrecognized line: %q", path, line))
+				continue
+			}
+			field = strings.ToLower(strings.TrimSpace(name))
+			stanza[field] = strings.TrimSpace(value)
+		}
+	}
+	flush()
+	return repos, warnings
+}
+
+func deb822Repositories(path string, stanza map[string]string) ([]Repository, []string) {
+	types, uris, suites := strings.Fields(stanza["types"]), strings.Fields(stanza["uris"]), strings.Fields(stanza["suites"])
+	if len(types) == 0 || len(uris) == 0 || len(suites) == 0 {
+		return nil, []string{fmt.Sprintf("%s: stanza without Types, URIs or Suites", path)}
+	}
+
+	template := Repository{
+		Source:     path,
+		Enabled:    !strings.EqualFold(stanza["enabled"], "no"),
+		Components: strings.Fields(stanza["components"]),
+		Unsigned:   strings.EqualFold(stanza["trusted"], "yes"),
+	}
+	var warnings []string
+	if signedBy := stanza["signed-by"]; strings.Contains(signedBy, "-----BEGIN PGP") {
+		fingerprints, err := keyFingerprints([]byte(signedBy))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: embedded key: %v", path, err))
+		}
+		template.Fingerprints = fingerprints
+	} else {
+		setSignedBy(&template, strings.FieldsFunc(signedBy, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n'
+		}))
+	}
+
+	var repos []Repository
+	for _, typ := range types {
+		for _, uri := range uris {
+			for _, suite := range suites {
+				repo := template
+				repo.Type, repo.URL, repo.Suite = typ, uri, suite
+				repos = append(repos, repo)
+			}
+		}
+	}
+	return repos, warnings
+}
+
+// parseRepoFile parses a yum/dnf .repo file, an INI file with one section per
+// repository. Values continue on indented lines; baseurl and gpgkey hold
+// lists separated by whitespace or commas.
+func parseRepoFile(path, content string) ([]Repository, []string) {
+	var repos []Repository
+	var warnings []string
+
+	var repo *Repository
+	var section map[string]string
+	var key string
+	flush := func() {
+		if repo == nil {
+			return
+		}
+		list := func(s string) []string {
+			return strings.FieldsFunc(s, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\n'
+			})
+		}
+		repo.Name = section["name"]
+		switch strings.ToLower(section["enabled"]) {
+		case "0", "no", "false", "off":
+			repo.Enabled = false
+		}
+		if urls := list(section["baseurl"]); len(urls) > 0 {
+			repo.URL = urls[0]
+		} else if section["mirrorlist"] != "" {
+			repo.URL = section["mirrorlist"]
+		} else {
+			repo.URL = section["metalink"]
+		}
+		if keys := list(section["gpgkey"]); len(keys) > 0 {
+			repo.Keys = keys
+		}
+		switch strings.ToLower(section["gpgcheck"]) {
+		case "0", "no", "false", "off":
+			repo.Unsigned = true
+		}
+		repos = append(repos, *repo)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";"):
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			flush()
+			repo = &Repository{Type: "rpm", Source: path, ID: strings.TrimSpace(trimmed[1 : len(trimmed)-1]), Enabled: true}
+			section = make(map[string]string)
+			key = ""
+		case repo == nil:
+			warnings = append(warnings, fmt.Sprintf("%s: line outside a section: %q", path, line))
+		case (line[0] == ' ' || line[0] == '\t') && key != "":
+			section[key] += "\n" + trimmed
+		default:
+			name, value, ok := strings.Cut(trimmed, "=")
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: unrecognized line: %q", path, line))
+				continue
+			}
+			key = strings.ToLower(strings.TrimSpace(name))
+			section[key] = strings.TrimSpace(value)
+		}
+	}
+	flush()
+	return repos, warnings
+}
+
+// parseSnapList parses snap list: Name Version Rev Tracking Publisher Notes.
+// Snaps installed from a local file track no channel and are skipped.
+func parseSnapList(output string) []Repository {
+	var repos []Repository
+	for i, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 6 || fields[3] == "-" {
+			continue
+		}
+		repos = append(repos, Repository{
+			Type:      "snap",
+			Source:    "snap",
+			ID:        fields[0],
+			Enabled:   !strings.Contains(fields[5], "disabled"),
+			Channel:   fields[3],
+			Publisher: strings.TrimRight(fields[4], "*"),
+		})
+	}
+	return repos
+}
+
+// resolveKeyFingerprints adds the fingerprints of the keys in local key
+// files. Keys only available at a URL are not fetched.
+func resolveKeyFingerprints(repos []Repository) []string {
+	var warnings []string
+	cache := make(map[string][]string)
+	for i := range repos {
+		for _, key := range repos[i].Keys {
+			path := strings.TrimPrefix(key, "file://")
+			if !strings.HasPrefix(path, "/") {
+				continue
+			}
+			fingerprints, ok := cache[path]
+			if !ok {
+				data, err := os.ReadFile(path)
+				if err == nil {
+					fingerprints, err = keyFingerprints(data)
+				}
+				if err != nil {
+					warnings = append(warnings, fmt.Sprintf("key %s: %v", path, err))
+				}
+				cache[path] = fingerprints
+			}
+			for _, fingerprint := range fingerprints {
+				if !slices.Contains(repos[i].Fingerprints, fingerprint) {
+					repos[i].Fingerprints = append(repos[i].Fingerprints, fingerprint)
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// keyFingerprints returns the fingerprints of the primary keys in an OpenPGP
+// keyring, binary or ASCII armored
+func keyFingerprints(data []byte) ([]string, error) {
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		var err error
+		if data, err = dearmor(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var fingerprints []string
+	for len(data) > 0 {
+		tag, body, rest, err := nextPacket(data)
+		if err != nil {
+			return fingerprints, err
+		}
+		// 6 is a public key packet; subkeys (14) and signatures are skipped
+		if tag == 6 {
+			if fingerprint := keyFingerprint(body); fingerprint != "" {
+				fingerprints = append(fingerprints, fingerprint)
+			}
+		}
+		data = rest
+	}
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no OpenPGP public key found")
+	}
+	return fingerprints, nil
+}
+
+// dearmor decodes the first ASCII armored block: headers up to a blank line,
+// base64 data, and a "=" checksum line
+func dearmor(data []byte) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+	var b64 strings.Builder
+	inBlock, inHeaders := false, false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP"):
+			inBlock, inHeaders = true, true
+		case !inBlock:
+		case strings.HasPrefix(line, "-----END PGP"):
+			return base64.StdEncoding.DecodeString(b64.String())
+		case inHeaders:
+			if line == "" {
+				inHeaders = false
+			} else if !strings.Contains(line, ":") {
+				// no headers and no blank line, the data starts right away
+				inHeaders = false
+				b64.WriteString(line)
+			}
+		case strings.HasPrefix(line, "="):
+		default:
+			b64.WriteString(line)
+		}
+	}
+	return nil, errors.New("unterminated armored key")
+}
+
+// nextPacket splits the first OpenPGP packet off data (RFC 4880 section 4.2)
+func nextPacket(data []byte) (tag byte, body, rest []byte, err error) {
+	if data[0]&0x80 == 0 {
+		return 0, nil, nil, errors.New("not an OpenPGP keyring")
+	}
+
+	var length, offset int
+	if data[0]&0x40 != 0 {
+		// new format
+		tag = data[0] & 0x3f
+		if len(data) < 2 {
+			return 0, nil, nil, errors.New("truncated packet")
+		}
+		switch l := int(data[1]); {
+		case l < 192:
+			length, offset = l, 2
+		case l < 224 && len(data) >= 3:
+			length, offset = (l-192)<<8+int(data[2])+192, 3
+		case l == 255 && len(data) >= 6:
+			length, offset = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, errors.New("unsupported packet length")
+		}
+	} else {
+		// old format
+		tag = (data[0] >> 2) & 0x0f
+		switch data[0] & 0x03 {
+		case 0:
+			if len(data) >= 2 {
+				length, offset = int(data[1]), 2
+			}
+		case 1:
+			if len(data) >= 3 {
+				length, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+			}
+		case 2:
+			if len(data) >= 5 {
+				length, offset = int(binary.BigEndian.Uint32(data[1:5])), 5
+			}
+		case 3:
+			length, offset = len(data)-1, 1
+		}
+		if offset == 0 {
+			return 0, nil, nil, errors.New("truncated packet")
+		}
+	}
+
+	if length < 0 || offset+length > len(data) {
+		return 0, nil, nil, errors.New("truncated packet")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// keyFingerprint computes the fingerprint of a public key packet body: SHA-1
+// for version 4 keys, SHA-256 for versions 5 and 6
+func keyFingerprint(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var h hash.Hash
+	switch body[0] {
+	case 4:
+		h = sha1.New()
+		h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+	case 5, 6:
+		h = sha256.New()
+		prefix := byte(0x9a)
+		if body[0] == 6 {
+			prefix = 0x9b
+		}
+		h.Write([]byte{prefix})
+		binary.Write(h, binary.BigEndian, uint32(len(body)))
+	default:
+		return ""
+	}
+	h.Write(body)
+	return fmt.Sprintf("%X", h.Sum(nil))
+}
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	nodesourceFingerprint     = "6F71F525282841EEDAF851B42F59B5F99B1BE0B4"
+	debianSecurityFingerprint = "05AB90340C0C5E797F44A8C8254CF3B5AEC0A8F0"
+)
+
+func TestParseAptSourcesList(t *testing.T) {
+	repos, warnings := parseAptSourcesList("sources.list", readTestdata(t, "sources-jammy.list"))
+
+	expected := []Repository{
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "http://archive.ubuntu.com/ubuntu/", Suite: "jammy", Components: []string{"main", "restricted"}},
+		{Type: "deb-src", Source: "sources.list", URL: "http://archive.ubuntu.com/ubuntu/", Suite: "jammy", Components: []string{"main", "restricted"}},
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "http://archive.ubuntu.com/ubuntu/", Suite: "jammy-updates", Components: []string{"main", "restricted", "universe", "multiverse"}},
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "http://security.ubuntu.com/ubuntu", Suite: "jammy-security", Components: []string{"main", "restricted"}},
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "https://deb.nodesource.com/node_20.x", Suite: "nodistro", Components: []string{"main"}, Keys: []string{"/etc/apt/keyrings/nodesource.gpg"}},
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "https://download.docker.com/linux/ubuntu", Suite: "jammy", Components: []string{"stable"}, Fingerprints: []string{"C5AD17C747E3415A3642D57D77C6C491D6AC1D69"}},
+		{Type: "deb", Source: "sources.list", Enabled: true, URL: "cdrom:[Ubuntu 22.04 LTS _Jammy Jellyfish_]/", Suite: "jammy", Components: []string{"main"}},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Unexpected repositories:\n%+v\nexpected:\n%+v", repos, expected)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected a warning about the incomplete line, got %q", warnings)
+	}
+}
+
+func TestParseDeb822Sources(t *testing.T) {
+	repos, warnings := parseDeb822Sources("debian.sources", readTestdata(t, "debian-bookworm.sources"))
+	if len(warnings) > 0 {
+		t.Errorf("Unexpected warnings: %q", warnings)
+	}
+
+	var got []string
+	for _, repo := range repos {
+		got = append(got, repo.Type+" "+repo.URL+" "+repo.Suite)
+	}
+	expected := []string{
+		"deb http://deb.debian.org/debian bookworm",
+		"deb http://deb.debian.org/debian bookworm-updates",
+		"deb-src http://deb.debian.org/debian bookworm",
+		"deb-src http://deb.debian.org/debian bookworm-updates",
+		"deb http://deb.debian.org/debian bookworm-backports",
+		"deb https://deb.nodesource.com/node_20.x nodistro",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Unexpected repositories: %q", got)
+	}
+
+	if !repos[0].Enabled || !reflect.DeepEqual(repos[0].Components, []string{"main", "contrib"}) ||
+		!reflect.DeepEqual(repos[0].Keys, []string{"/usr/share/keyrings/debian-archive-keyring.gpg"}) {
+		t.Errorf("Unexpected first repository: %+v", repos[0])
+	}
+	if repos[4].Enabled {
+		t.Errorf("Expected backports to be disabled")
+	}
+	// the key is embedded in Signed-By
+	if len(repos[5].Keys) != 0 || !reflect.DeepEqual(repos[5].Fingerprints, []string{nodesourceFingerprint}) {
+		t.Errorf("Unexpected keys of the embedded key repository: %+v", repos[5])
+	}
+}
+
+func TestParseRepoFile(t *testing.T) {
+	repos, warnings := parseRepoFile("rocky.repo", readTestdata(t, "rocky-el9.repo"))
+	if len(warnings) > 0 {
+		t.Errorf("Unexpected warnings: %q", warnings)
+	}
+
+	expected := []Repository{
+		{Type: "rpm", Source: "rocky.repo", ID: "baseos", Name: "Rocky Linux $releasever - BaseOS", Enabled: true,
+			URL:  "https://mirrors.rockylinux.org/mirrorlist?arch=$basearch&repo=BaseOS-$releasever$rltype",
+			Keys: []string{"file:///etc/pki/rpm-gpg/RPM-GPG-KEY-Rocky-9"}},
+		{Type: "rpm", Source: "rocky.repo", ID: "baseos-debug", Name: "Rocky Linux $releasever - BaseOS - Debug",
+			URL:  "https://mirrors.rockylinux.org/mirrorlist?arch=$basearch&repo=BaseOS-$releasever-debug$rltype",
+			Keys: []string{"file:///etc/pki/rpm-gpg/RPM-GPG-KEY-Rocky-9"}},
+		{Type: "rpm", Source: "rocky.repo", ID: "epel", Name: "Extra Packages for Enterprise Linux 9 - $basearch", Enabled: true,
+			URL:  "https://mirrors.fedoraproject.org/metalink?repo=epel-9&arch=$basearch&infra=$infra&content=$contentdir",
+			Keys: []string{"file:///etc/pki/rpm-gpg/RPM-GPG-KEY-EPEL-9", "https://dl.fedoraproject.org/pub/epel/RPM-GPG-KEY-EPEL-9"}},
+		{Type: "rpm", Source: "rocky.repo", ID: "internal", Name: "Internal packages", Enabled: true,
+			URL: "https://repo.example.com/el9/$basearch/", Unsigned: true},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Unexpected repositories:\n%+v\nexpected:\n%+v", repos, expected)
+	}
+}
+
+func TestParseSnapList(t *testing.T) {
+	repos := parseSnapList(readTestdata(t, "snap-list.txt"))
+
+	expected := []Repository{
+		{Type: "snap", Source: "snap", ID: "core22", Enabled: true, Channel: "latest/stable", Publisher: "canonical"},
+		{Type: "snap", Source: "snap", ID: "lxd", Enabled: true, Channel: "5.0/stable/...", Publisher: "canonical"},
+		{Type: "snap", Source: "snap", ID: "snapd", Enabled: true, Channel: "latest/stable", Publisher: "canonical"},
+		{Type: "snap", Source: "snap", ID: "firefox", Channel: "latest/stable", Publisher: "mozilla"},
+	}
+	if !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Unexpected snaps:\n%+v\nexpected:\n%+v", repos, expected)
+	}
+}
+
+func TestKeyFingerprints(t *testing.T) {
+	tests := []struct {
+		file string
+		want []string
+	}{
+		{"nodesource.gpg", []string{nodesourceFingerprint}},
+		{"debian-bookworm-security.asc", []string{debianSecurityFingerprint}},
+	}
+	for _, test := range tests {
+		got, err := keyFingerprints([]byte(readTestdata(t, test.file)))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got fingerprints %q, expected %q", test.file, got, test.want)
+		}
+	}
+
+	if _, err := keyFingerprints([]byte("not a key")); err == nil {
+		t.Errorf("Expected an error for data that is not a keyring")
+	}
+}
+
+func TestResolveKeyFingerprints(t *testing.T) {
+	keyring, err := filepath.Abs(filepath.Join("testdata", "nodesource.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.gpg")
+	if _, err := os.Stat(missing); err == nil {
+		t.Fatal("missing key exists")
+	}
+
+	repos := []Repository{
+		{Type: "deb", Keys: []string{keyring}},
+		{Type: "rpm", Keys: []string{"file://" + keyring, "https://example.com/key.asc"}},
+		{Type: "deb", Keys: []string{missing}},
+	}
+	warnings := resolveKeyFingerprints(repos)
+
+	for i := 0; i < 2; i++ {
+		if !reflect.DeepEqual(repos[i].Fingerprints, []string{nodesourceFingerprint}) {
+			t.Errorf("Unexpected fingerprints of repository %d: %q", i, repos[i].Fingerprints)
+		}
+	}
+	if len(repos[2].Fingerprints) != 0 || len(warnings) != 1 {
+		t.Errorf("Expected a warning for the missing key, got %q", warnings)
+	}
+}
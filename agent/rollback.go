@@ -0,0 +1,460 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluet/redt-agent/utils"
+	"golang.org/x/exp/slices"
+)
+
+const upgradesDir = "upgrades"
+
+// PackageChange is a package whose installed version an upgrade changed
+type PackageChange struct {
+	Name       string `json:"name"`
+	Arch       string `json:"arch,omitempty"`
+	OldVersion string `json:"old_version,omitempty"` // empty for newly installed packages
+	NewVersion string `json:"new_version,omitempty"` // empty for removed packages
+}
+
+// RevertFailure is a package a rollback could not return to its previous version
+type RevertFailure struct {
+	Name    string `json:"name"`
+	Arch    string `json:"arch,omitempty"`
+	Version string `json:"version,omitempty"` // the version it should have been reverted to
+	Reason  string `json:"reason"`
+}
+
+// installedPackages maps "name arch" to the installed versions, several for
+// packages like kernels that keep older versions installed
+type installedPackages map[string][]string
+
+// listInstalledPackages queries the package database directly, which is fast
+// and does not need privileges
+func listInstalledPackages(pm string) (installedPackages, error) {
+	var cmd *exec.Cmd
+	switch pm {
+	case "apt-get":
+		cmd = exec.Command("dpkg-query", "-W", "-f", "${Package} ${Architecture} ${Version} ${db:Status-Abbrev}\n")
+	case "dnf", "yum":
+		cmd = exec.Command("rpm", "-qa", "--qf", "%{NAME} %{ARCH} %{EPOCHNUM}:%{VERSION}-%{RELEASE}\n")
+	default:
+		return nil, fmt.Errorf("unsupported package manager")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list installed packages: %v", err)
+	}
+	return parseInstalledPackages(string(out)), nil
+}
+
+func parseInstalledPackages(output string) installedPackages {
+	installed := make(installedPackages)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		// dpkg also lists removed packages that left configuration files behind
+		if len(fields) > 3 && (len(fields[3]) < 2 || fields[3][1] != 'i') {
+			continue
+		}
+		version := strings.TrimPrefix(fields[2], "0:")
+		key := fields[0] + " " + fields[1]
+		installed[key] = append(installed[key], version)
+	}
+	for _, versions := range installed {
+		sort.Strings(versions)
+	}
+	return installed
+}
+
+// diffInstalledPackages returns the changes between two snapshots
+func diffInstalledPackages(before, after installedPackages) []PackageChange {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	var changes []PackageChange
+	for key := range keys {
+		removed, added := versionsOnlyIn(before[key], after[key]), versionsOnlyIn(after[key], before[key])
+		if len(removed) == 0 && len(added) == 0 {
+			continue
+		}
+		name, arch, _ := strings.Cut(key, " ")
+		change := PackageChange{Name: name, Arch: arch}
+		if len(removed) > 0 {
+			change.OldVersion = removed[0]
+		}
+		if len(added) > 0 {
+			change.NewVersion = added[0]
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Arch < changes[j].Arch
+	})
+	return changes
+}
+
+func versionsOnlyIn(a, b []string) []string {
+	var only []string
+	for _, version := range a {
+		if !slices.Contains(b, version) {
+			only = append(only, version)
+		}
+	}
+	return only
+}
+
+// lastTransaction returns the ID of the newest dnf/yum history transaction
+func lastTransaction(pm string) string {
+	// reading the history database requires root
+	out, err := privilegedCommand(pm, "history", "list").Output()
+	if err != nil {
+		return ""
+	}
+	// ID | Command line | Date and time | Action(s) | Altered, newest first
+	for _, line := range strings.Split(string(out), "\n") {
+		id, _, found := strings.Cut(line, "|")
+		id = strings.TrimSpace(id)
+		if found && id != "" && strings.Trim(id, "0123456789") == "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// recordChanges runs upgrade between two snapshots of the installed packages
+// and records what changed in result, so the upgrade can be rolled back. It
+// first waits for any other package manager run to finish.
+func recordChanges(config *Config, result *UpgradeResult, upgrade func() error) error {
+	defer invalidateRebootStatus()
+
+	if err := waitForPackageManager(config.Upgrades.LockTimeout); err != nil {
+		return err
+	}
+
+	pm, err := getPackageManager()
+	if err != nil {
+		return upgrade()
+	}
+
+	before, err := listInstalledPackages(pm)
+	if err != nil {
+		log.Printf("Not recording package changes: %v\n", err)
+		return upgrade()
+	}
+	var transactionBefore string
+	if pm != "apt-get" {
+		transactionBefore = lastTransaction(pm)
+	}
+
+	upgradeErr := upgrade()
+
+	// recorded even after a failure, which may have changed some packages
+	after, err := listInstalledPackages(pm)
+	if err != nil {
+		log.Printf("Not recording package changes: %v\n", err)
+		return upgradeErr
+	}
+	result.PackageManager = pm
+	result.Changes = diffInstalledPackages(before, after)
+	if pm != "apt-get" {
+		if transaction := lastTransaction(pm); transaction != transactionBefore {
+			result.Transaction = transaction
+		}
+	}
+	return upgradeErr
+}
+
+// saveUpgradeRecord keeps the result of an upgrade that changed packages in
+// state_dir/upgrades, where rollback finds it
+func saveUpgradeRecord(config *Config, result UpgradeResult) {
+	if len(result.Changes) == 0 {
+		return
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding upgrade record: %v\n", err)
+		return
+	}
+	if err := writeStateFile(filepath.Join(config.StateDir, upgradesDir), result.ID+".json", data); err != nil {
+		log.Printf("Error saving upgrade record %s: %v\n", result.ID, err)
+	}
+}
+
+func loadUpgradeRecord(config *Config, id string) (*UpgradeResult, error) {
+	// IDs are hex; anything else could escape the upgrades directory
+	if id == "" || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("invalid upgrade ID %q", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.StateDir, upgradesDir, id+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no record of upgrade %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade record: %v", err)
+	}
+
+	var record UpgradeResult
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse upgrade record: %v", err)
+	}
+	return &record, nil
+}
+
+// rollbackUpgrade returns the packages changed by upgrade to their previous
+// versions, as far as the package manager still has them, and records the
+// rollback itself in result. Packages that did not end up at their previous
+// version are listed in result.NotReverted.
+func rollbackUpgrade(config *Config, upgrade *UpgradeResult, result *UpgradeResult) error {
+	return withUpgradeLock(config, func() error {
+		return rollbackUpgradeLocked(config, upgrade, result)
+	})
+}
+
+func rollbackUpgradeLocked(config *Config, upgrade *UpgradeResult, result *UpgradeResult) error {
+	result.RollbackOf = upgrade.ID
+	if len(upgrade.Changes) == 0 {
+		return fmt.Errorf("upgrade %s changed no packages", upgrade.ID)
+	}
+
+	pm, err := getPackageManager()
+	if err != nil {
+		return err
+	}
+	if pm != upgrade.PackageManager {
+		return fmt.Errorf("upgrade %s was made with %s, not %s", upgrade.ID, upgrade.PackageManager, pm)
+	}
+
+	var skipped []RevertFailure
+	rollbackErr := recordChanges(config, result, func() error {
+		switch pm {
+		case "apt-get":
+			var err error
+			skipped, err = rollbackApt(upgrade.Changes)
+			return err
+		default:
+			return rollbackDnfYum(pm, upgrade.Transaction)
+		}
+	})
+
+	installed, err := listInstalledPackages(pm)
+	if err != nil {
+		return err
+	}
+	result.NotReverted = append(skipped, unrevertedPackages(upgrade.Changes, installed, skipped, rollbackErr)...)
+
+	if rollbackErr != nil {
+		return rollbackErr
+	}
+	if len(result.NotReverted) > 0 {
+		return fmt.Errorf("%d package(s) could not be reverted", len(result.NotReverted))
+	}
+	return nil
+}
+
+// unrevertedPackages compares the installed versions with the ones before the upgrade
+func unrevertedPackages(changes []PackageChange, installed installedPackages, skipped []RevertFailure, rollbackErr error) []RevertFailure {
+	reason := "still at the upgraded version"
+	if rollbackErr != nil {
+		reason = rollbackErr.Error()
+	}
+
+	var failures []RevertFailure
+	for _, change := range changes {
+		if isSkipped(skipped, change) {
+			continue
+		}
+		versions := installed[change.Name+" "+change.Arch]
+		// packages installed by the upgrade are reverted by removing them
+		reverted := !slices.Contains(versions, change.NewVersion) &&
+			(change.OldVersion == "" || slices.Contains(versions, change.OldVersion))
+		if !reverted {
+			failures = append(failures, RevertFailure{
+				Name:    change.Name,
+				Arch:    change.Arch,
+				Version: change.OldVersion,
+				Reason:  reason,
+			})
+		}
+	}
+	return failures
+}
+
+func isSkipped(skipped []RevertFailure, change PackageChange) bool {
+	for _, failure := range skipped {
+		if failure.Name == change.Name && failure.Arch == change.Arch {
+			return true
+		}
+	}
+	return false
+}
+
+// rollbackApt installs the previous version of every changed package in one
+// apt-get call, from the repositories or the local package cache. Packages
+// whose previous version is no longer available are returned as skipped.
+func rollbackApt(changes []PackageChange) ([]RevertFailure, error) {
+	var targets []string
+	var skipped []RevertFailure
+	for _, change := range changes {
+		pkg := change.Name
+		if change.Arch != "all" {
+			pkg += ":" + change.Arch
+		}
+		if change.OldVersion == "" {
+			// a new dependency of the upgrade
+			targets = append(targets, pkg+"-")
+			continue
+		}
+
+		if exec.Command("apt-cache", "show", pkg+"="+change.OldVersion).Run() == nil {
+			targets = append(targets, pkg+"="+change.OldVersion)
+			continue
+		}
+		// dpkg encodes the epoch colon in archive file names
+		cached := fmt.Sprintf("/var/cache/apt/archives/%s_%s_%s.deb", change.Name, strings.ReplaceAll(change.OldVersion, ":", "%3a"), change.Arch)
+		if _, err := os.Stat(cached); err == nil {
+			targets = append(targets, cached)
+			continue
+		}
+		skipped = append(skipped, RevertFailure{
+			Name:    change.Name,
+			Arch:    change.Arch,
+			Version: change.OldVersion,
+			Reason:  "previous version is no longer available from any repository or the package cache",
+		})
+	}
+	if len(targets) == 0 {
+		return skipped, nil
+	}
+
+	args := append([]string{"install", "-y", "--allow-downgrades"}, targets...)
+	cmd := privilegedCommand("apt-get", args...)
+	cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Printf("Running apt-get %s\n", strings.Join(args, " "))
+	if err := cmd.Run(); err != nil {
+		return skipped, fmt.Errorf("apt-get failed: %v", err)
+	}
+	return skipped, nil
+}
+
+// rollbackDnfYum undoes the upgrade's history transaction, which dnf and yum
+// apply all or nothing
+func rollbackDnfYum(pm, transaction string) error {
+	if transaction == "" {
+		return errors.New("no history transaction recorded for the upgrade")
+	}
+
+	cmd := privilegedCommand(pm, "history", "undo", "-y", transaction)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Printf("Running %s history undo -y %s\n", pm, transaction)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s history undo failed: %v", pm, err)
+	}
+	return nil
+}
+
+// RunRollback reverts a recorded upgrade from the command line
+func RunRollback(upgradeID string, autoYes bool) error {
+	config, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading configuration: %v", err)
+	}
+
+	upgrade, err := loadUpgradeRecord(config, upgradeID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Upgrade %s (%s) changed %d package(s):\n", upgrade.ID, upgrade.StartedAt.Format(time.RFC3339), len(upgrade.Changes))
+	for _, change := range upgrade.Changes {
+		fmt.Printf("  - %s (%s): %s -> %s\n", change.Name, change.Arch, change.OldVersion, change.NewVersion)
+	}
+	if !autoYes {
+		fmt.Print("Do you want to revert these changes? (y/N) ")
+		var answer string
+		fmt.Scanln(&answer)
+		if answer != "y" && answer != "Y" {
+			return nil
+		}
+	}
+
+	result := UpgradeResult{
+		ID:        utils.RandomID(),
+		Hostname:  config.Hostname,
+		Trigger:   UpgradeTriggerCLI,
+		StartedAt: time.Now(),
+	}
+	err = rollbackUpgrade(config, upgrade, &result)
+	finishUpgradeResult(config, &result, err)
+
+	if config.FileSink.Enabled {
+		sink, sinkErr := NewFileSink(config.FileSink)
+		if sinkErr != nil {
+			return fmt.Errorf("Error opening file sink: %v", sinkErr)
+		}
+		defer sink.Close()
+		if sinkErr := sink.ReportUpgradeResult(config, result); sinkErr != nil {
+			return fmt.Errorf("Error recording rollback result: %v", sinkErr)
+		}
+	}
+
+	for _, failure := range result.NotReverted {
+		fmt.Printf("Could not revert %s (%s) to %s: %s\n", failure.Name, failure.Arch, failure.Version, failure.Reason)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rollback of upgrade %s completed successfully.\n", upgrade.ID)
+	return nil
+}
+
+// runInstructedRollback reverts a recorded upgrade on behalf of a verified
+// backend instruction and reports the outcome
+func runInstructedRollback(config *Config, instruction *Instruction, reporter UpgradeResultReporter) (UpgradeResult, error) {
+	result := UpgradeResult{
+		ID:            utils.RandomID(),
+		InstructionID: instruction.ID,
+		Hostname:      config.Hostname,
+		Trigger:       UpgradeTriggerBackend,
+		StartedAt:     time.Now(),
+	}
+
+	upgrade, err := loadUpgradeRecord(config, instruction.UpgradeID)
+	if err == nil {
+		err = rollbackUpgrade(config, upgrade, &result)
+	}
+	finishUpgradeResult(config, &result, err)
+
+	if reporter != nil {
+		if reportErr := reporter.ReportUpgradeResult(config, result); reportErr != nil {
+			log.Printf("Error reporting rollback result: %v\n", reportErr)
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffInstalledPackages(t *testing.T) {
+	before := parseInstalledPackages(`curl amd64 7.81.0-1ubuntu1.15 ii 
+libssl3 amd64 3.0.2-0ubuntu1.12 ii 
+oldlib amd64 1.0-1 ii 
+removed amd64 2.0-1 rc 
+linux-image-5.15.0-91-generic amd64 5.15.0-91.101 ii 
+`)
+	after := parseInstalledPackages(`curl amd64 7.81.0-1ubuntu1.16 ii 
+libssl3 amd64 3.0.2-0ubuntu1.12 ii 
+newdep amd64 0.5-1 ii 
+linux-image-5.15.0-91-generic amd64 5.15.0-91.101 ii 
+`)
+
+	want := []PackageChange{
+		{Name: "curl", Arch: "amd64", OldVersion: "7.81.0-1ubuntu1.15", NewVersion: "7.81.0-1ubuntu1.16"},
+		{Name: "newdep", Arch: "amd64", NewVersion: "0.5-1"},
+		{Name: "oldlib", Arch: "amd64", OldVersion: "1.0-1"},
+	}
+	if got := diffInstalledPackages(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffInstalledPackages() = %+v, want %+v", got, want)
+	}
+
+	// rpm keeps several kernels installed and prints an epoch
+	before = parseInstalledPackages("kernel-core x86_64 0:5.14.0-362.8.1.el9_3\nbash x86_64 0:5.1.8-6.el9\n")
+	after = parseInstalledPackages("kernel-core x86_64 0:5.14.0-362.8.1.el9_3\nkernel-core x86_64 0:5.14.0-362.13.1.el9_3\nbash x86_64 0:5.1.8-9.el9\n")
+	want = []PackageChange{
+		{Name: "bash", Arch: "x86_64", OldVersion: "5.1.8-6.el9", NewVersion: "5.1.8-9.el9"},
+		{Name: "kernel-core", Arch: "x86_64", NewVersion: "5.14.0-362.13.1.el9_3"},
+	}
+	if got := diffInstalledPackages(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffInstalledPackages() = %+v, want %+v", got, want)
+	}
+}
+
+func TestUnrevertedPackages(t *testing.T) {
+	changes := []PackageChange{
+		{Name: "curl", Arch: "amd64", OldVersion: "1.0", NewVersion: "1.1"},
+		{Name: "newdep", Arch: "amd64", NewVersion: "0.5"},
+		{Name: "libfoo", Arch: "amd64", OldVersion: "2.0", NewVersion: "2.1"},
+		{Name: "gone", Arch: "amd64", OldVersion: "3.0", NewVersion: "3.1"},
+	}
+	installed := installedPackages{
+		"curl amd64":   {"1.0"},
+		"libfoo amd64": {"2.1"},
+		"gone amd64":   {"3.1"},
+	}
+	skipped := []RevertFailure{{Name: "gone", Arch: "amd64", Version: "3.0", Reason: "not available"}}
+
+	failures := unrevertedPackages(changes, installed, skipped, nil)
+	if len(failures) != 1 || failures[0].Name != "libfoo" || failures[0].Version != "2.0" {
+		t.Errorf("Expected only libfoo to be reported as not reverted, got %+v", failures)
+	}
+}
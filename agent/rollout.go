@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// hostFraction maps the host and salt to a stable number in [0, 1). The
+// enrolled agent ID is preferred over the hostname, which may be reused.
+func hostFraction(config *Config, salt string) float64 {
+	credentialMu.RLock()
+	key := config.AgentID
+	credentialMu.RUnlock()
+	if key == "" {
+		key = config.Hostname
+	}
+
+	sum := sha256.Sum256([]byte(key + "\x00" + salt))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// applyRollout decides whether this host takes part in a staged upgrade and,
+// if it does, defers the instruction by its share of MaxDelay. Both are
+// derived from a stable host hash, so every host makes the same decision each
+// time it sees an instruction and the fleet spreads out evenly. It returns
+// why the host is not selected, or "" if it is.
+func applyRollout(config *Config, instruction *Instruction) string {
+	if len(instruction.Groups) > 0 && !slices.Contains(instruction.Groups, config.Rollout.Group) {
+		return fmt.Sprintf("rollout group %q is not one of %q", config.Rollout.Group, instruction.Groups)
+	}
+
+	if instruction.Percent > 0 && instruction.Percent < 100 {
+		// hashed on the rollout rather than the instruction, so that hosts
+		// selected at a lower percentage stay selected as it is raised
+		bucket := int(hostFraction(config, "rollout:"+instruction.Rollout) * 100)
+		if bucket >= instruction.Percent {
+			return fmt.Sprintf("host is in bucket %d, outside the first %d%% of rollout %q", bucket, instruction.Percent, instruction.Rollout)
+		}
+	}
+
+	if instruction.MaxDelay > 0 {
+		delay := time.Duration(hostFraction(config, "delay:"+instruction.ID) * float64(time.Duration(instruction.MaxDelay)*time.Second))
+		start := instruction.IssuedAt.Add(delay)
+		if start.After(instruction.NotBefore) {
+			instruction.NotBefore = start
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestApplyRollout(t *testing.T) {
+	issuedAt := time.Date(2024, 3, 16, 12, 0, 0, 0, time.UTC)
+
+	config := &Config{Hostname: "db1", Rollout: RolloutConfig{Group: "canary"}}
+	if reason := applyRollout(config, &Instruction{ID: "a", Groups: []string{"canary", "ring1"}}); reason != "" {
+		t.Errorf("Expected canary host to be selected, got %q", reason)
+	}
+	if reason := applyRollout(config, &Instruction{ID: "a", Groups: []string{"ring2"}}); reason == "" {
+		t.Error("Expected host outside the rollout groups to be skipped")
+	}
+
+	// hosts selected at a lower percentage stay selected as it is raised
+	selected := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		config := &Config{Hostname: fmt.Sprintf("host%d", i)}
+		wasSelected := false
+		for _, percent := range []int{10, 50, 100} {
+			instruction := &Instruction{ID: fmt.Sprintf("i%d", percent), Rollout: "2024-03", Percent: percent}
+			isSelected := applyRollout(config, instruction) == ""
+			if wasSelected && !isSelected {
+				t.Fatalf("%s dropped out of the rollout at %d%%", config.Hostname, percent)
+			}
+			if isSelected {
+				selected[percent]++
+			}
+			wasSelected = isSelected
+		}
+	}
+	if selected[10] < 50 || selected[10] > 150 || selected[50] < 420 || selected[50] > 580 || selected[100] != 1000 {
+		t.Errorf("Uneven rollout selection: %v", selected)
+	}
+
+	// the delay is stable for a host and within MaxDelay
+	first := &Instruction{ID: "i1", IssuedAt: issuedAt, MaxDelay: 3600}
+	second := &Instruction{ID: "i1", IssuedAt: issuedAt, MaxDelay: 3600}
+	applyRollout(config, first)
+	applyRollout(config, second)
+	if !first.NotBefore.Equal(second.NotBefore) {
+		t.Errorf("Expected a stable delay, got %s and %s", first.NotBefore, second.NotBefore)
+	}
+	if first.NotBefore.Before(issuedAt) || !first.NotBefore.Before(issuedAt.Add(time.Hour)) {
+		t.Errorf("Expected start within an hour of %s, got %s", issuedAt, first.NotBefore)
+	}
+
+	// an explicit NotBefore later than the staggered start wins
+	notBefore := issuedAt.Add(2 * time.Hour)
+	instruction := &Instruction{ID: "i1", IssuedAt: issuedAt, MaxDelay: 3600, NotBefore: notBefore}
+	applyRollout(config, instruction)
+	if !instruction.NotBefore.Equal(notBefore) {
+		t.Errorf("Expected NotBefore %s to be kept, got %s", notBefore, instruction.NotBefore)
+	}
+}
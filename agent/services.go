@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const deletedSuffix = " (deleted)"
+
+// ServiceRestart is a systemd unit whose processes still run code that an
+// upgrade replaced on disk
+type ServiceRestart struct {
+	Unit      string   `json:"unit"`
+	PIDs      []int    `json:"pids"`
+	Files     []string `json:"files"` // deleted executables and libraries still mapped
+	Restarted bool     `json:"restarted,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// checkServices finds the units needing a restart and restarts the allowlisted ones
+func checkServices(config *Config) []ServiceRestart {
+	services := scanServices(config)
+	if len(services) == 0 {
+		return nil
+	}
+
+	// never restart the unit the agent itself runs in, in the middle of an upgrade
+	ownUnit := unitForPID("/proc", os.Getpid())
+
+	for i := range services {
+		service := &services[i]
+		log.Printf("Service %s uses deleted files: %s\n", service.Unit, strings.Join(service.Files, ", "))
+		if service.Unit == ownUnit || !matchesAny(config.Services.Restart, service.Unit) {
+			continue
+		}
+
+		out, err := privilegedCommand("systemctl", "restart", service.Unit).CombinedOutput()
+		if err != nil {
+			service.Error = fmt.Sprintf("%v: %s", err, strings.TrimSpace(string(out)))
+			log.Printf("Error restarting %s: %s\n", service.Unit, service.Error)
+			continue
+		}
+		service.Restarted = true
+		log.Printf("Restarted %s\n", service.Unit)
+	}
+	return services
+}
+
+// scanServices finds the units needing a restart. Only root can read the
+// memory maps of other users' processes, so an unprivileged daemon has the
+// root helper scan them when one is configured.
+func scanServices(config *Config) []ServiceRestart {
+	if os.Geteuid() != 0 && config.Upgrades.HelperSocket != "" {
+		output, err := callHelper(config.Upgrades.HelperSocket, HelperOpFindServices)
+		if err == nil {
+			var services []ServiceRestart
+			if err = json.Unmarshal([]byte(output), &services); err == nil {
+				return services
+			}
+		}
+		log.Printf("Error scanning services through the helper: %v\n", err)
+	}
+	return findServicesNeedingRestart("/proc")
+}
+
+// findServicesNeedingRestart scans the processes under procRoot, logging
+// when some of them could not be read and may be missing from the result
+func findServicesNeedingRestart(procRoot string) []ServiceRestart {
+	services, unreadable := scanProcesses(procRoot)
+	if unreadable > 0 {
+		log.Printf("Service scan is partial: the memory maps of %d processes are unreadable as uid %d\n", unreadable, os.Geteuid())
+	}
+	return services
+}
+
+// scanProcesses scans the processes under procRoot for mapped executables
+// and shared libraries that have been deleted, i.e. replaced by an upgrade,
+// and groups them by systemd service. Processes outside a service, such as
+// login sessions, are left out. It also returns how many processes could not
+// be read.
+func scanProcesses(procRoot string) ([]ServiceRestart, int) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		log.Printf("Error scanning processes: %v\n", err)
+		return nil, 0
+	}
+
+	byUnit := make(map[string]*ServiceRestart)
+	unreadable := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		files, err := deletedMappings(procRoot, pid)
+		if err != nil {
+			unreadable++
+		}
+		if len(files) == 0 {
+			continue
+		}
+		unit := unitForPID(procRoot, pid)
+		if unit == "" {
+			continue
+		}
+
+		service, ok := byUnit[unit]
+		if !ok {
+			service = &ServiceRestart{Unit: unit}
+			byUnit[unit] = service
+		}
+		service.PIDs = append(service.PIDs, pid)
+		for _, file := range files {
+			if !slices.Contains(service.Files, file) {
+				service.Files = append(service.Files, file)
+			}
+		}
+	}
+
+	var services []ServiceRestart
+	for _, service := range byUnit {
+		sort.Ints(service.PIDs)
+		sort.Strings(service.Files)
+		services = append(services, *service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Unit < services[j].Unit })
+	return services, unreadable
+}
+
+// deletedMappings returns the deleted executable and shared libraries of a
+// process. A process that vanished has none; one whose memory maps cannot be
+// read, e.g. another user's without root, returns an error.
+func deletedMappings(procRoot string, pid int) ([]string, error) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+
+	var files []string
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil && strings.HasSuffix(exe, deletedSuffix) {
+		files = append(files, strings.TrimSuffix(exe, deletedSuffix))
+	}
+
+	f, err := os.Open(filepath.Join(dir, "maps"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return files, nil
+	}
+	if err != nil {
+		return files, err
+	}
+	defer f.Close()
+
+	// address perms offset dev inode pathname
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		file := strings.TrimSpace(fields[5])
+		if !strings.HasSuffix(file, deletedSuffix) {
+			continue
+		}
+		file = strings.TrimSuffix(file, deletedSuffix)
+		// shared memory and memfd mappings are deleted by design
+		if !strings.HasPrefix(file, "/") || strings.HasPrefix(file, "/dev/") || strings.HasPrefix(file, "/memfd:") {
+			continue
+		}
+		if !strings.Contains(filepath.Base(file), ".so") {
+			continue
+		}
+		if !slices.Contains(files, file) {
+			files = append(files, file)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// unitForPID returns the systemd service a process belongs to, from its
+// cgroup path, e.g. 0::/system.slice/nginx.service
+func unitForPID(procRoot string, pid int) string {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		// cgroup v2 has a single "0::" line; v1 names the systemd hierarchy
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 || !(parts[0] == "0" && parts[1] == "" || parts[1] == "name=systemd") {
+			continue
+		}
+		components := strings.Split(parts[2], "/")
+		for i := len(components) - 1; i >= 0; i-- {
+			if strings.HasSuffix(components[i], ".service") {
+				return components[i]
+			}
+		}
+	}
+	return ""
+}
+
+// matchesAny reports whether name matches one of the shell patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
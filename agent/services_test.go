@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindServicesNeedingRestart(t *testing.T) {
+	procRoot := t.TempDir()
+	writeProc := func(pid, exe, maps, cgroup string) {
+		dir := filepath.Join(procRoot, pid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(dir, "maps"), []byte(maps), 0644)
+		os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0644)
+	}
+
+	writeProc("101", "/usr/sbin/nginx",
+		"7f1c2a000000-7f1c2a028000 r--p 00000000 08:01 131090                     /usr/lib/x86_64-linux-gnu/libssl.so.3 (deleted)\n"+
+			"7f1c2a028000-7f1c2a0bd000 r-xp 00028000 08:01 131090                     /usr/lib/x86_64-linux-gnu/libssl.so.3 (deleted)\n"+
+			"7f1c2b000000-7f1c2b001000 rw-s 00000000 00:01 4096                       /dev/shm/nginx (deleted)\n"+
+			"7f1c2c000000-7f1c2c001000 r--p 00000000 08:01 131091                     /usr/lib/x86_64-linux-gnu/libc.so.6\n",
+		"0::/system.slice/nginx.service\n")
+	writeProc("102", "/usr/sbin/nginx", "7f1c2a000000-7f1c2a028000 r--p 00000000 08:01 131090 /usr/lib/x86_64-linux-gnu/libssl.so.3 (deleted)\n",
+		"0::/system.slice/nginx.service\n")
+	// cgroup v1, replaced executable
+	writeProc("200", "/usr/sbin/sshd (deleted)", "",
+		"12:pids:/system.slice/ssh.service\n1:name=systemd:/system.slice/ssh.service\n")
+	// login session, not a service
+	writeProc("300", "/usr/bin/bash", "7f00-7f01 r--p 00000000 08:01 1 /usr/lib/libreadline.so.8.2 (deleted)\n",
+		"0::/user.slice/user-1000.slice/session-3.scope\n")
+	// nothing deleted
+	writeProc("400", "/usr/sbin/cron", "7f00-7f01 r--p 00000000 08:01 1 /usr/lib/libc.so.6\n",
+		"0::/system.slice/cron.service\n")
+
+	want := []ServiceRestart{
+		{Unit: "nginx.service", PIDs: []int{101, 102}, Files: []string{"/usr/lib/x86_64-linux-gnu/libssl.so.3"}},
+		{Unit: "ssh.service", PIDs: []int{200}, Files: []string{"/usr/sbin/sshd"}},
+	}
+	got := findServicesNeedingRestart(procRoot)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findServicesNeedingRestart() = %+v, want %+v", got, want)
+	}
+
+	if !matchesAny([]string{"php*-fpm.service"}, "php8.2-fpm.service") || matchesAny([]string{"nginx.service"}, "ssh.service") {
+		t.Error("Unexpected allowlist matching")
+	}
+}
+
+func TestScanProcessesUnreadable(t *testing.T) {
+	procRoot := t.TempDir()
+	// a process whose maps cannot be read, like a root service seen by an unprivileged daemon
+	if err := os.MkdirAll(filepath.Join(procRoot, "500", "maps"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(procRoot, "500", "cgroup"), []byte("0::/system.slice/postgresql.service\n"), 0644)
+	// a process that exited during the scan
+	os.MkdirAll(filepath.Join(procRoot, "501"), 0755)
+
+	services, unreadable := scanProcesses(procRoot)
+	if len(services) != 0 || unreadable != 1 {
+		t.Errorf("scanProcesses() = %+v, %d unreadable, want none and 1 unreadable", services, unreadable)
+	}
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// Snapshot kinds
+const (
+	SnapshotZFS   = "zfs"
+	SnapshotBtrfs = "btrfs"
+	SnapshotLVM   = "lvm"
+)
+
+// snapshotPrefix marks the snapshots the agent created, the only ones it prunes
+const snapshotPrefix = "redt-"
+
+// Snapshot is a snapshot of the root filesystem taken before an upgrade
+type Snapshot struct {
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"` // dataset@snapshot, snapshot path or vg/lv
+	CreatedAt time.Time `json:"created_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// snapshotter creates and lists the agent's snapshots of one filesystem
+type snapshotter interface {
+	kind() string
+	create(name string) (string, error)
+	list() ([]string, error) // agent-created snapshots, full names
+	remove(name string) error
+}
+
+// takeSnapshot snapshots the root filesystem and prunes the oldest snapshots
+// beyond the retention count. id makes the snapshot name unique.
+func takeSnapshot(config *SnapshotConfig, id string) (*Snapshot, error) {
+	s, err := rootSnapshotter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	snapshot := &Snapshot{Kind: s.kind(), CreatedAt: now}
+	// the timestamp first, so that names sort by age
+	name := snapshotPrefix + now.Format("20060102T150405Z") + "-" + id[:min(8, len(id))]
+	snapshot.Name, err = s.create(name)
+	if err != nil {
+		snapshot.Error = err.Error()
+		return snapshot, fmt.Errorf("failed to create %s snapshot: %v", s.kind(), err)
+	}
+	log.Printf("Created %s snapshot %s\n", s.kind(), snapshot.Name)
+
+	if config.Retention > 0 {
+		existing, err := s.list()
+		if err != nil {
+			log.Printf("Error listing %s snapshots: %v\n", s.kind(), err)
+			return snapshot, nil
+		}
+		for _, old := range snapshotsToPrune(existing, config.Retention) {
+			if err := s.remove(old); err != nil {
+				log.Printf("Error removing %s snapshot %s: %v\n", s.kind(), old, err)
+				continue
+			}
+			log.Printf("Removed %s snapshot %s\n", s.kind(), old)
+		}
+	}
+	return snapshot, nil
+}
+
+// snapshotsToPrune returns the oldest of the agent's snapshots beyond retention
+func snapshotsToPrune(names []string, retention int) []string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	if len(sorted) <= retention {
+		return nil
+	}
+	return sorted[:len(sorted)-retention]
+}
+
+// rootSnapshotter picks the snapshot tool for the filesystem mounted at /
+func rootSnapshotter(config *SnapshotConfig) (snapshotter, error) {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list filesystems: %v", err)
+	}
+
+	for _, partition := range partitions {
+		if partition.Mountpoint != "/" {
+			continue
+		}
+		switch partition.Fstype {
+		case "zfs":
+			return zfsSnapshotter{dataset: partition.Device}, nil
+		case "btrfs":
+			return btrfsSnapshotter{dir: config.BtrfsDir}, nil
+		default:
+			vg, lv, err := logicalVolume(partition.Device)
+			if err != nil {
+				return nil, fmt.Errorf("root filesystem %s on %s cannot be snapshotted: %v", partition.Fstype, partition.Device, err)
+			}
+			return lvmSnapshotter{vg: vg, lv: lv, size: config.LVMSize}, nil
+		}
+	}
+	return nil, errors.New("root filesystem not found")
+}
+
+type zfsSnapshotter struct {
+	dataset string
+}
+
+func (z zfsSnapshotter) kind() string {
+	return SnapshotZFS
+}
+
+func (z zfsSnapshotter) create(name string) (string, error) {
+	full := z.dataset + "@" + name
+	return full, runSnapshotCommand("zfs", "snapshot", full)
+}
+
+func (z zfsSnapshotter) list() ([]string, error) {
+	out, err := exec.Command("zfs", "list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", z.dataset).Output()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Fields(string(out)) {
+		if strings.HasPrefix(name, z.dataset+"@"+snapshotPrefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (z zfsSnapshotter) remove(name string) error {
+	return runSnapshotCommand("zfs", "destroy", name)
+}
+
+type btrfsSnapshotter struct {
+	dir string
+}
+
+func (b btrfsSnapshotter) kind() string {
+	return SnapshotBtrfs
+}
+
+func (b btrfsSnapshotter) create(name string) (string, error) {
+	if err := runSnapshotCommand("mkdir", "-p", b.dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(b.dir, name)
+	return path, runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", "/", path)
+}
+
+func (b btrfsSnapshotter) list() ([]string, error) {
+	return filepath.Glob(filepath.Join(b.dir, snapshotPrefix+"*"))
+}
+
+func (b btrfsSnapshotter) remove(path string) error {
+	return runSnapshotCommand("btrfs", "subvolume", "delete", path)
+}
+
+type lvmSnapshotter struct {
+	vg, lv string
+	size   string // lvcreate -L size, or -l extents when it is a percentage like 10%ORIGIN
+}
+
+func (l lvmSnapshotter) kind() string {
+	return SnapshotLVM
+}
+
+func (l lvmSnapshotter) create(name string) (string, error) {
+	sizeFlag := "-L"
+	if strings.Contains(l.size, "%") {
+		sizeFlag = "-l"
+	}
+	return l.vg + "/" + name, runSnapshotCommand("lvcreate", "-s", "-n", name, sizeFlag, l.size, l.vg+"/"+l.lv)
+}
+
+func (l lvmSnapshotter) list() ([]string, error) {
+	out, err := privilegedCommand("lvs", "--noheadings", "-o", "lv_name,origin", l.vg).Output()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == l.lv && strings.HasPrefix(fields[0], snapshotPrefix) {
+			names = append(names, l.vg+"/"+fields[0])
+		}
+	}
+	return names, nil
+}
+
+func (l lvmSnapshotter) remove(name string) error {
+	return runSnapshotCommand("lvremove", "-y", name)
+}
+
+// logicalVolume returns the volume group and logical volume of an LVM device
+// like /dev/mapper/vg-root
+func logicalVolume(device string) (string, string, error) {
+	out, err := privilegedCommand("lvs", "--noheadings", "-o", "vg_name,lv_name", device).Output()
+	if err != nil {
+		return "", "", errors.New("not an LVM logical volume")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected lvs output %q", strings.TrimSpace(string(out)))
+	}
+	return fields[0], fields[1], nil
+}
+
+func runSnapshotCommand(name string, args ...string) error {
+	out, err := privilegedCommand(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
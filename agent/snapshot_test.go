@@ -0,0 +1,26 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotsToPrune(t *testing.T) {
+	names := []string{
+		"rpool/ROOT/ubuntu@redt-20240316T120000Z-3f2a9c1d",
+		"rpool/ROOT/ubuntu@redt-20240301T020000Z-aa01bb02",
+		"rpool/ROOT/ubuntu@redt-20240310T020000Z-0c0d0e0f",
+		"rpool/ROOT/ubuntu@redt-20240220T020000Z-11223344",
+	}
+
+	want := []string{
+		"rpool/ROOT/ubuntu@redt-20240220T020000Z-11223344",
+		"rpool/ROOT/ubuntu@redt-20240301T020000Z-aa01bb02",
+	}
+	if got := snapshotsToPrune(names, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshotsToPrune() = %v, want %v", got, want)
+	}
+	if got := snapshotsToPrune(names, 4); got != nil {
+		t.Errorf("Expected nothing to prune within retention, got %v", got)
+	}
+}
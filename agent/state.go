@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFile = "state.json"
+
+// AgentState is what the daemon keeps across restarts, in state_dir/state.json.
+// The enrolled credential, the remote config overlay and the upgrade history
+// (state_dir/upgrades) are kept in their own files in the same directory.
+type AgentState struct {
+	LastUpgradeCheck      time.Time            `json:"last_upgrade_check"`
+	LastRemoteConfigCheck time.Time            `json:"last_remote_config_check"`
+	LastTelemetrySent     time.Time            `json:"last_telemetry_sent"`
+	PendingUpgrade        *Instruction         `json:"pending_upgrade,omitempty"`
+	PendingUpgradeCommand bool                 `json:"pending_upgrade_command,omitempty"` // the pending upgrade arrived as a command, not by polling
+	TelemetryBacklog      []TelemetryData      `json:"telemetry_backlog,omitempty"`
+	SeenNonces            map[string]time.Time `json:"seen_nonces,omitempty"` // nonce -> instruction expiry
+}
+
+// StateStore persists AgentState as a JSON file, rewritten atomically on
+// every change. A store without a directory only keeps the state in memory.
+type StateStore struct {
+	mu    sync.Mutex
+	dir   string
+	state AgentState
+	saved []byte
+}
+
+// OpenStateStore loads the state from dir. A missing file starts from an
+// empty state; a corrupt one is set aside rather than failing the daemon.
+func OpenStateStore(dir string) (*StateStore, error) {
+	store := &StateStore{dir: dir}
+
+	path := filepath.Join(dir, stateFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent state: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		log.Printf("Discarding corrupt agent state %s: %v\n", path, err)
+		os.Rename(path, path+".corrupt")
+		store.state = AgentState{}
+		return store, nil
+	}
+	store.saved = data
+	return store, nil
+}
+
+// State returns a copy of the current state
+func (s *StateStore) State() AgentState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Update applies fn to the state and saves it if anything changed
+func (s *StateStore) Update(fn func(state *AgentState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(&s.state)
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode agent state: %v", err)
+	}
+	if bytes.Equal(data, s.saved) {
+		return nil
+	}
+	if err := writeStateFile(s.dir, stateFile, data); err != nil {
+		return fmt.Errorf("failed to save agent state: %v", err)
+	}
+	s.saved = data
+	return nil
+}
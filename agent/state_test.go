@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenStateStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to open empty state: %v", err)
+	}
+	if !store.State().LastUpgradeCheck.IsZero() {
+		t.Error("Expected empty state for a new state dir")
+	}
+
+	checked := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = store.Update(func(state *AgentState) {
+		state.LastUpgradeCheck = checked
+		state.PendingUpgrade = &Instruction{ID: "instr-1", Action: ActionUpgrade, NotBefore: checked.Add(time.Hour)}
+		state.SeenNonces = map[string]time.Time{"nonce-1": checked.Add(time.Hour)}
+	})
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	reopened, err := OpenStateStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen state: %v", err)
+	}
+	state := reopened.State()
+	if !state.LastUpgradeCheck.Equal(checked) || state.PendingUpgrade == nil || state.PendingUpgrade.ID != "instr-1" {
+		t.Errorf("State not restored: %+v", state)
+	}
+
+	verifier := NewInstructionVerifier()
+	verifier.RestoreSeenNonces(state.SeenNonces)
+	if _, ok := verifier.SeenNonces()["nonce-1"]; !ok {
+		t.Error("Expected restored nonce to be remembered")
+	}
+
+	// a corrupt file is set aside instead of failing the daemon
+	path := filepath.Join(dir, stateFile)
+	os.WriteFile(path, []byte("{not json"), 0600)
+	store, err = OpenStateStore(dir)
+	if err != nil || !store.State().LastUpgradeCheck.IsZero() {
+		t.Errorf("Expected empty state from corrupt file, got %+v, %v", store.State(), err)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("Expected corrupt state to be kept aside: %v", err)
+	}
+}
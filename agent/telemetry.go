@@ -1,9 +1,8 @@
 package agent
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os/user"
 	"time"
@@ -21,14 +20,50 @@ func (d DefaultTelemetryDataProvider) CollectTelemetryData(config *Config) (Tele
 	return collectTelemetryData(config)
 }
 
-type DefaultTelemetryDataSender struct{}
+// DefaultTelemetryDataSender posts telemetry to the backend. When batching is
+// enabled, samples that failed to send are kept and uploaded together with the
+// next one in a single request.
+type DefaultTelemetryDataSender struct {
+	backlog  []TelemetryData
+	lastSent time.Time
+}
+
+func (d *DefaultTelemetryDataSender) SendTelemetryData(config *Config, data TelemetryData) error {
+	if !config.Upload.Batch {
+		if err := sendTelemetryData(config, data); err != nil {
+			return err
+		}
+		d.lastSent = time.Now()
+		return nil
+	}
 
-func (d DefaultTelemetryDataSender) SendTelemetryData(config *Config, data TelemetryData) error {
-	return sendTelemetryData(config, data)
+	batch := append(d.backlog, data)
+	if config.Upload.MaxBatch > 0 && len(batch) > config.Upload.MaxBatch {
+		// drop the oldest samples rather than growing without bound
+		batch = batch[len(batch)-config.Upload.MaxBatch:]
+	}
+
+	var err error
+	if len(batch) == 1 {
+		err = sendTelemetryData(config, data)
+	} else {
+		err = sendTelemetryBatch(config, batch)
+	}
+	if err != nil {
+		d.backlog = batch
+		return err
+	}
+
+	d.backlog = nil
+	d.lastSent = time.Now()
+	return nil
 }
 
 func collectTelemetryData(config *Config) (TelemetryData, error) {
 	var data TelemetryData
+	data.Timestamp = time.Now().UTC()
+	data.ConfigVersion = config.RemoteConfigVersion
+	data.RolloutGroup = config.Rollout.Group
 
 	// Collect CPU usage
 	cpuPercent, err := cpu.Percent(time.Second, false)
@@ -92,18 +127,35 @@ func collectTelemetryData(config *Config) (TelemetryData, error) {
 		data.LoggedInUsers = append(data.LoggedInUsers, user.User)
 	}
 
+	data.Reboot = detectRebootRequired()
+
+	drift, err := checkPackageDrift(&config.Packages)
+	if err != nil {
+		log.Printf("Error checking package drift: %v\n", err)
+	}
+	data.PackageDrift = drift
+
 	return data, nil
 }
 
 func sendTelemetryData(config *Config, data TelemetryData) error {
-	jsonData, err := json.Marshal(data)
+	resp, err := postJSON(config, config.TelemetryEndpoint, data)
 	if err != nil {
-		return fmt.Errorf("failed to marshal telemetry data: %v", err)
+		return fmt.Errorf("failed to send telemetry data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
 	}
 
-	resp, err := http.Post(config.TelemetryEndpoint, "application/json", bytes.NewBuffer(jsonData))
+	return nil
+}
+
+func sendTelemetryBatch(config *Config, batch []TelemetryData) error {
+	resp, err := postJSON(config, config.TelemetryBatchEndpoint, batch)
 	if err != nil {
-		return fmt.Errorf("failed to send telemetry data: %v", err)
+		return fmt.Errorf("failed to send %d telemetry samples: %v", len(batch), err)
 	}
 	defer resp.Body.Close()
 
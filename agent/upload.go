@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported request body encodings for backend uploads
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// postJSON marshals payload and posts it to url, compressing the body
+// according to config.Upload.Compression.
+func postJSON(config *Config, url string, payload interface{}) (*http.Response, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %v", err)
+	}
+
+	body, err := encodeBody(config.Upload.Compression, data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Upload.Compression != CompressionNone {
+		req.Header.Set("Content-Encoding", config.Upload.Compression)
+	}
+
+	return doBackendRequest(config, req)
+}
+
+func encodeBody(compression string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to gzip payload: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip payload: %v", err)
+		}
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to zstd payload: %v", err)
+		}
+		if _, err := zw.Write(data); err != nil {
+			zw.Close()
+			return nil, fmt.Errorf("failed to zstd payload: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to zstd payload: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	return buf.Bytes(), nil
+}
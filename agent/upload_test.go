@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTelemetryBatchingWithGzip(t *testing.T) {
+	failNext := true
+	var batches [][]TelemetryData
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != CompressionGzip {
+			t.Errorf("expected gzip Content-Encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("request body is not gzip: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/telemetry":
+			if failNext {
+				failNext = false
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/telemetry/batch":
+			var batch []TelemetryData
+			if err := json.NewDecoder(zr).Decode(&batch); err != nil {
+				t.Errorf("invalid batch body: %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			batches = append(batches, batch)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	testConfig := getTestConfig()
+	testConfig.TelemetryEndpoint = server.URL + "/telemetry"
+	testConfig.TelemetryBatchEndpoint = server.URL + "/telemetry/batch"
+	testConfig.Upload = UploadConfig{Compression: CompressionGzip, Batch: true, MaxBatch: 10}
+
+	sender := &DefaultTelemetryDataSender{}
+	if err := sender.SendTelemetryData(testConfig, TelemetryData{OSInfo: "first"}); err == nil {
+		t.Fatal("expected first send to fail")
+	}
+	if err := sender.SendTelemetryData(testConfig, TelemetryData{OSInfo: "second"}); err != nil {
+		t.Fatalf("SendTelemetryData() error = %v", err)
+	}
+
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected one batch of 2 samples, got %v", batches)
+	}
+	if batches[0][0].OSInfo != "first" || batches[0][1].OSInfo != "second" {
+		t.Errorf("unexpected batch order: %v", batches[0])
+	}
+	if len(sender.backlog) != 0 {
+		t.Errorf("expected backlog to be cleared, got %d samples", len(sender.backlog))
+	}
+}
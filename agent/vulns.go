@@ -0,0 +1,525 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/bluet/redt-agent/version"
+)
+
+// Severities, from most to least severe
+const (
+	SeverityCritical = "critical"
+	SeverityHigh     = "high"
+	SeverityMedium   = "medium"
+	SeverityLow      = "low"
+	SeverityUnknown  = "unknown"
+)
+
+var severityRank = map[string]int{
+	SeverityCritical: 4,
+	SeverityHigh:     3,
+	SeverityMedium:   2,
+	SeverityLow:      1,
+	SeverityUnknown:  0,
+}
+
+// CVE is a vulnerability in the installed version of a package
+type CVE struct {
+	ID       string `json:"id"` // the CVE ID, or the advisory ID if the feed has none
+	Severity string `json:"severity"`
+	Fixed    bool   `json:"fixed"` // whether NewVersion fixes it
+}
+
+// osvEntry is the part of an OSV record (https://ossf.github.io/osv-schema/) the agent uses
+type osvEntry struct {
+	ID               string          `json:"id"`
+	Aliases          []string        `json:"aliases"`
+	Withdrawn        string          `json:"withdrawn"`
+	Severity         []osvSeverity   `json:"severity"`
+	Affected         []osvAffected   `json:"affected"`
+	DatabaseSpecific json.RawMessage `json:"database_specific"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvAffected struct {
+	Package struct {
+		Ecosystem string `json:"ecosystem"`
+		Name      string `json:"name"`
+	} `json:"package"`
+	Ranges []struct {
+		Type   string `json:"type"`
+		Events []struct {
+			Introduced   string `json:"introduced"`
+			Fixed        string `json:"fixed"`
+			LastAffected string `json:"last_affected"`
+		} `json:"events"`
+	} `json:"ranges"`
+	Versions          []string        `json:"versions"`
+	EcosystemSpecific json.RawMessage `json:"ecosystem_specific"`
+	DatabaseSpecific  json.RawMessage `json:"database_specific"`
+}
+
+// vulnerabilityFeed indexes the affected packages of a feed by package name
+type vulnerabilityFeed struct {
+	byName map[string][]feedMatch
+}
+
+type feedMatch struct {
+	cve      string
+	severity string
+	affected *osvAffected
+}
+
+var feedCache struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	feed    *vulnerabilityFeed
+}
+
+// loadVulnerabilityFeed reads an OSV feed: a JSON file with one record or an
+// array of records, or a directory of such files. The feed is kept in memory
+// until the file changes.
+func loadVulnerabilityFeed(path string) (*vulnerabilityFeed, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vulnerability feed: %v", err)
+	}
+
+	feedCache.Lock()
+	defer feedCache.Unlock()
+	if feedCache.feed != nil && feedCache.path == path && feedCache.modTime.Equal(info.ModTime()) {
+		return feedCache.feed, nil
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	feed := &vulnerabilityFeed{byName: make(map[string][]feedMatch)}
+	for _, file := range files {
+		entries, err := readOSVFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vulnerability feed %s: %v", file, err)
+		}
+		feed.add(entries)
+	}
+
+	feedCache.path, feedCache.modTime, feedCache.feed = path, info.ModTime(), feed
+	return feed, nil
+}
+
+func readOSVFile(path string) ([]osvEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	first, err := firstNonSpace(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []osvEntry
+	if first == '[' {
+		err = json.NewDecoder(r).Decode(&entries)
+	} else {
+		var entry osvEntry
+		err = json.NewDecoder(r).Decode(&entry)
+		entries = append(entries, entry)
+	}
+	return entries, err
+}
+
+// firstNonSpace peeks at the first significant byte of r
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if !unicode.IsSpace(rune(b)) {
+			return b, r.UnreadByte()
+		}
+	}
+}
+
+func (f *vulnerabilityFeed) add(entries []osvEntry) {
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Withdrawn != "" {
+			continue
+		}
+		id := cveID(entry)
+		for j := range entry.Affected {
+			affected := &entry.Affected[j]
+			f.byName[affected.Package.Name] = append(f.byName[affected.Package.Name], feedMatch{
+				cve:      id,
+				severity: osvSeverityOf(entry, affected),
+				affected: affected,
+			})
+		}
+	}
+}
+
+// match returns the vulnerabilities affecting installedVersion of any of the
+// names (binary and source package) in ecosystem, and whether newVersion fixes them
+func (f *vulnerabilityFeed) match(ecosystem string, names []string, installedVersion, newVersion string) []CVE {
+	format := ecosystemFormat(ecosystem)
+	var cves []CVE
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for _, m := range f.byName[name] {
+			if seen[m.cve] || !ecosystemMatches(m.affected.Package.Ecosystem, ecosystem) || !osvAffects(m.affected, format, installedVersion) {
+				continue
+			}
+			seen[m.cve] = true
+			cves = append(cves, CVE{
+				ID:       m.cve,
+				Severity: m.severity,
+				Fixed:    newVersion != "" && !osvAffects(m.affected, format, newVersion),
+			})
+		}
+	}
+	return cves
+}
+
+// ecosystemMatches reports whether a feed ecosystem like "Ubuntu:22.04:LTS"
+// or "Debian" applies to the host's ecosystem like "Ubuntu:22.04"
+func ecosystemMatches(feed, host string) bool {
+	return feed == host || strings.HasPrefix(feed, host+":") || strings.HasPrefix(host, feed+":")
+}
+
+// ecosystemFormat returns the version syntax of an OSV ecosystem
+func ecosystemFormat(ecosystem string) version.Format {
+	if strings.HasPrefix(ecosystem, "Debian") || strings.HasPrefix(ecosystem, "Ubuntu") {
+		return version.Deb
+	}
+	return version.RPM
+}
+
+// osvAffects evaluates the affected versions and ECOSYSTEM ranges for v
+func osvAffects(affected *osvAffected, format version.Format, v string) bool {
+	for _, affectedVersion := range affected.Versions {
+		if version.Compare(format, affectedVersion, v) == 0 {
+			return true
+		}
+	}
+	for _, r := range affected.Ranges {
+		if r.Type != "ECOSYSTEM" {
+			continue
+		}
+		vulnerable := false
+		for _, event := range r.Events {
+			switch {
+			case event.Introduced != "":
+				if event.Introduced == "0" || version.Compare(format, v, event.Introduced) >= 0 {
+					vulnerable = true
+				}
+			case event.Fixed != "":
+				if version.Compare(format, v, event.Fixed) >= 0 {
+					vulnerable = false
+				}
+			case event.LastAffected != "":
+				if version.Compare(format, v, event.LastAffected) > 0 {
+					vulnerable = false
+				}
+			}
+		}
+		if vulnerable {
+			return true
+		}
+	}
+	return false
+}
+
+// cveID prefers the CVE ID over distribution advisory IDs like DSA-5532-1
+func cveID(entry *osvEntry) string {
+	if strings.HasPrefix(entry.ID, "CVE-") {
+		return entry.ID
+	}
+	for _, alias := range entry.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			return alias
+		}
+	}
+	return entry.ID
+}
+
+// osvSeverityOf normalizes the severity the feeds carry in different places:
+// Debian's urgency, Ubuntu's priority, database_specific.severity (GHSA,
+// AlmaLinux, Rocky Linux) or a CVSS v3 vector or score
+func osvSeverityOf(entry *osvEntry, affected *osvAffected) string {
+	var specific struct {
+		Severity string `json:"severity"`
+		Urgency  string `json:"urgency"`
+	}
+	for _, raw := range []json.RawMessage{affected.EcosystemSpecific, affected.DatabaseSpecific, entry.DatabaseSpecific} {
+		if len(raw) == 0 {
+			continue
+		}
+		specific.Severity, specific.Urgency = "", ""
+		if json.Unmarshal(raw, &specific) != nil {
+			continue
+		}
+		for _, s := range []string{specific.Severity, specific.Urgency} {
+			if severity := normalizeSeverity(s); severity != SeverityUnknown {
+				return severity
+			}
+		}
+	}
+	for _, s := range entry.Severity {
+		if !strings.HasPrefix(s.Score, "CVSS:") {
+			if severity := normalizeSeverity(s.Score); severity != SeverityUnknown {
+				return severity
+			}
+			continue
+		}
+		// only v3 vectors are scored, a CVSS_V4 vector alone leaves the severity unknown
+		score, err := cvssV3BaseScore(s.Score)
+		if err != nil {
+			log.Printf("Cannot score %s severity of %s: %v\n", s.Type, entry.ID, err)
+			continue
+		}
+		if severity := scoreSeverity(score); severity != SeverityUnknown {
+			return severity
+		}
+	}
+	return SeverityUnknown
+}
+
+func normalizeSeverity(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "critical":
+		return SeverityCritical
+	case "high", "important":
+		return SeverityHigh
+	case "medium", "moderate":
+		return SeverityMedium
+	case "low", "negligible", "unimportant":
+		return SeverityLow
+	}
+	if score, err := strconv.ParseFloat(s, 64); err == nil {
+		return scoreSeverity(score)
+	}
+	return SeverityUnknown
+}
+
+// scoreSeverity maps a CVSS score to its qualitative severity
+func scoreSeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return SeverityCritical
+	case score >= 7:
+		return SeverityHigh
+	case score >= 4:
+		return SeverityMedium
+	case score > 0:
+		return SeverityLow
+	}
+	return SeverityUnknown
+}
+
+// maxSeverity returns the highest severity of cves
+func maxSeverity(cves []CVE) string {
+	severity := SeverityUnknown
+	for _, cve := range cves {
+		if severityRank[cve.Severity] > severityRank[severity] {
+			severity = cve.Severity
+		}
+	}
+	return severity
+}
+
+// fixesSeverity reports whether the update of pkg fixes a vulnerability of
+// at least the given severity
+func fixesSeverity(pkg PackageInfo, severity string) bool {
+	for _, cve := range pkg.CVEs {
+		if cve.Fixed && severityRank[cve.Severity] >= severityRank[severity] {
+			return true
+		}
+	}
+	return false
+}
+
+// hostEcosystem returns the OSV ecosystem of the running distribution, e.g.
+// "Debian:12" or "AlmaLinux:9"
+func hostEcosystem(osReleasePath string) (string, error) {
+	data, err := os.ReadFile(osReleasePath)
+	if err != nil {
+		return "", err
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if ok {
+			fields[key] = strings.Trim(value, `"'`)
+		}
+	}
+
+	version := fields["VERSION_ID"]
+	major, _, _ := strings.Cut(version, ".")
+	switch fields["ID"] {
+	case "debian":
+		return "Debian:" + major, nil
+	case "ubuntu":
+		return "Ubuntu:" + version, nil
+	case "almalinux":
+		return "AlmaLinux:" + major, nil
+	case "rocky":
+		return "Rocky Linux:" + major, nil
+	}
+	return "", fmt.Errorf("no OSV ecosystem known for %q, set vulnerabilities.ecosystem", fields["ID"])
+}
+
+// rpmArchs are the architecture suffixes dnf and yum append to package names
+var rpmArchs = []string{".x86_64", ".noarch", ".i686", ".i586", ".i386", ".aarch64", ".ppc64le", ".ppc64", ".s390x", ".armv7hl", ".src"}
+
+// baseName strips the architecture from names like curl.x86_64
+func baseName(name string) string {
+	for _, arch := range rpmArchs {
+		if trimmed, ok := strings.CutSuffix(name, arch); ok {
+			return trimmed
+		}
+	}
+	return name
+}
+
+// sourcePackages maps binary package names to their source package, the
+// name most distribution feeds use
+func sourcePackages(pm string) map[string]string {
+	var cmd *exec.Cmd
+	switch pm {
+	case "apt-get":
+		cmd = exec.Command("dpkg-query", "-W", "-f", "${Package} ${source:Package}\n")
+	case "dnf", "yum":
+		cmd = exec.Command("rpm", "-qa", "--qf", "%{NAME} %{SOURCERPM}\n")
+	default:
+		return nil
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Error listing source packages: %v\n", err)
+		return nil
+	}
+	return parseSourcePackages(string(out))
+}
+
+func parseSourcePackages(output string) map[string]string {
+	sources := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		source := fields[1]
+		// openssl-3.0.7-27.el9.src.rpm: the name is all but the last two dash-separated parts
+		if strings.HasSuffix(source, ".src.rpm") {
+			parts := strings.Split(source, "-")
+			if len(parts) < 3 {
+				continue
+			}
+			source = strings.Join(parts[:len(parts)-2], "-")
+		}
+		sources[fields[0]] = source
+	}
+	return sources
+}
+
+// matchVulnerabilities attaches the CVEs from the configured feed to the
+// upgradable packages, and adds installed packages that are vulnerable but
+// have no update. Without a feed the packages are returned unchanged.
+func matchVulnerabilities(config *VulnerabilitiesConfig, packages []PackageInfo) []PackageInfo {
+	if config.Feed == "" {
+		return packages
+	}
+	feed, err := loadVulnerabilityFeed(config.Feed)
+	if err != nil {
+		log.Printf("Not matching vulnerabilities: %v\n", err)
+		return packages
+	}
+	ecosystem := config.Ecosystem
+	if ecosystem == "" {
+		ecosystem, err = hostEcosystem("/etc/os-release")
+		if err != nil {
+			log.Printf("Not matching vulnerabilities: %v\n", err)
+			return packages
+		}
+	}
+	pm, err := getPackageManager()
+	if err != nil {
+		log.Printf("Not matching vulnerabilities: %v\n", err)
+		return packages
+	}
+
+	var installed installedPackages
+	if config.Installed {
+		installed, err = listInstalledPackages(pm)
+		if err != nil {
+			log.Printf("Not matching installed packages: %v\n", err)
+		}
+	}
+	return annotateVulnerabilities(feed, ecosystem, sourcePackages(pm), installed, packages)
+}
+
+func annotateVulnerabilities(feed *vulnerabilityFeed, ecosystem string, sources map[string]string, installed installedPackages, packages []PackageInfo) []PackageInfo {
+	names := func(name string) []string {
+		name = baseName(name)
+		if source, ok := sources[name]; ok && source != name {
+			return []string{name, source}
+		}
+		return []string{name}
+	}
+
+	upgradable := make(map[string]bool)
+	for i := range packages {
+		pkg := &packages[i]
+		upgradable[baseName(pkg.Name)] = true
+		pkg.CVEs = feed.match(ecosystem, names(pkg.Name), strings.TrimPrefix(pkg.Version, "0:"), strings.TrimPrefix(pkg.NewVersion, "0:"))
+		if len(pkg.CVEs) > 0 {
+			pkg.Severity = maxSeverity(pkg.CVEs)
+		}
+	}
+
+	for key, versions := range installed {
+		name, arch, _ := strings.Cut(key, " ")
+		if upgradable[name] {
+			continue
+		}
+		for _, installedVersion := range versions {
+			cves := feed.match(ecosystem, names(name), installedVersion, "")
+			if len(cves) == 0 {
+				continue
+			}
+			packages = append(packages, PackageInfo{
+				Name:     name,
+				Version:  installedVersion,
+				Arch:     arch,
+				CVEs:     cves,
+				Severity: maxSeverity(cves),
+			})
+		}
+	}
+	return packages
+}
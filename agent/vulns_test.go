@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testOSVFeed = `[
+  {
+    "id": "DSA-5532-1",
+    "aliases": ["CVE-2023-5678"],
+    "affected": [{
+      "package": {"ecosystem": "Debian:12", "name": "openssl"},
+      "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "3.0.11-1~deb12u2"}]}],
+      "ecosystem_specific": {"urgency": "high"}
+    }]
+  },
+  {
+    "id": "CVE-2024-0001",
+    "affected": [{
+      "package": {"ecosystem": "Debian:12", "name": "openssl"},
+      "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "3.0.0"}, {"fixed": "3.0.13-1~deb12u1"}]}]
+    }],
+    "database_specific": {"severity": "Critical"}
+  },
+  {
+    "id": "CVE-2024-0002",
+    "affected": [{
+      "package": {"ecosystem": "Debian:11", "name": "openssl"},
+      "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]
+    }],
+    "database_specific": {"severity": "critical"}
+  },
+  {
+    "id": "CVE-2024-0003",
+    "withdrawn": "2024-02-01T00:00:00Z",
+    "affected": [{
+      "package": {"ecosystem": "Debian:12", "name": "openssl"},
+      "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]
+    }]
+  },
+  {
+    "id": "CVE-2024-0004",
+    "severity": [{"type": "CVSS_V3", "score": "5.3"}],
+    "affected": [{
+      "package": {"ecosystem": "Debian", "name": "zlib"},
+      "versions": ["1:1.2.13.dfsg-1"]
+    }]
+  }
+]`
+
+func TestMatchVulnerabilities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+	if err := os.WriteFile(path, []byte(testOSVFeed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := loadVulnerabilityFeed(path)
+	if err != nil {
+		t.Fatalf("Failed to load feed: %v", err)
+	}
+
+	sources := map[string]string{"libssl3": "openssl", "zlib1g": "zlib"}
+	installed := installedPackages{
+		"libssl3 amd64": {"3.0.11-1~deb12u1"},
+		"zlib1g amd64":  {"1:1.2.13.dfsg-1"},
+		"curl amd64":    {"7.88.1-10+deb12u5"},
+	}
+	packages := []PackageInfo{{Name: "libssl3", Version: "3.0.11-1~deb12u1", NewVersion: "3.0.11-1~deb12u2", Arch: "amd64"}}
+
+	packages = annotateVulnerabilities(feed, "Debian:12", sources, installed, packages)
+	if len(packages) != 2 {
+		t.Fatalf("Expected libssl3 and the vulnerable zlib1g, got %+v", packages)
+	}
+
+	ssl := packages[0]
+	if ssl.Severity != SeverityCritical || len(ssl.CVEs) != 2 {
+		t.Fatalf("Unexpected libssl3 CVEs: %+v", ssl)
+	}
+	for _, cve := range ssl.CVEs {
+		switch cve.ID {
+		case "CVE-2023-5678":
+			if cve.Severity != SeverityHigh || !cve.Fixed {
+				t.Errorf("Expected a high CVE fixed by the update, got %+v", cve)
+			}
+		case "CVE-2024-0001":
+			if cve.Severity != SeverityCritical || cve.Fixed {
+				t.Errorf("Expected a critical CVE not fixed by the update, got %+v", cve)
+			}
+		default:
+			t.Errorf("Unexpected CVE %+v", cve)
+		}
+	}
+
+	zlib := packages[1]
+	if zlib.Name != "zlib1g" || zlib.NewVersion != "" || len(zlib.CVEs) != 1 || zlib.Severity != SeverityMedium {
+		t.Errorf("Unexpected zlib1g match: %+v", zlib)
+	}
+
+	if selected := criticalUpgrades(packages); len(selected) != 0 {
+		t.Errorf("Expected no update fixing a critical CVE, got %v", selected)
+	}
+	packages[0].NewVersion = "3.0.13-1~deb12u1"
+	packages = annotateVulnerabilities(feed, "Debian:12", sources, nil, packages[:1])
+	if selected := criticalUpgrades(packages); len(selected) != 1 || selected[0] != "libssl3" {
+		t.Errorf("Expected libssl3 to be selected, got %v", selected)
+	}
+}
+
+func TestHostEcosystem(t *testing.T) {
+	tests := map[string]string{
+		"ID=debian\nVERSION_ID=\"12\"\n":                 "Debian:12",
+		"ID=ubuntu\nVERSION_ID=\"22.04\"\n":              "Ubuntu:22.04",
+		"ID=\"almalinux\"\nVERSION_ID=\"9.3\"\n":         "AlmaLinux:9",
+		"ID=\"rocky\"\nID_LIKE=\"rhel\"\nVERSION_ID=8\n": "Rocky Linux:8",
+	}
+	for osRelease, want := range tests {
+		path := filepath.Join(t.TempDir(), "os-release")
+		os.WriteFile(path, []byte(osRelease), 0644)
+		if got, err := hostEcosystem(path); err != nil || got != want {
+			t.Errorf("hostEcosystem(%q) = %q, %v, expected %q", osRelease, got, err, want)
+		}
+	}
+}
+
+func TestParseSourcePackages(t *testing.T) {
+	sources := parseSourcePackages("libssl3 openssl\nopenssl-libs openssl-3.0.7-27.el9.src.rpm\ngpg-pubkey (none)\n")
+	if sources["libssl3"] != "openssl" || sources["openssl-libs"] != "openssl" {
+		t.Errorf("Unexpected source packages: %v", sources)
+	}
+	if baseName("openssl-libs.x86_64") != "openssl-libs" {
+		t.Errorf("Expected the architecture to be stripped")
+	}
+}
+
+func TestCVSSV3BaseScore(t *testing.T) {
+	tests := map[string]float64{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 9.8,
+		"CVSS:3.1/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:H/A:H": 7.8,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N": 6.1,
+		"CVSS:3.1/AV:N/AC:H/PR:N/UI:N/S:U/C:H/I:N/A:N": 5.9,
+		"CVSS:3.0/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H": 10,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N": 0,
+	}
+	for vector, want := range tests {
+		if got, err := cvssV3BaseScore(vector); err != nil || got != want {
+			t.Errorf("cvssV3BaseScore(%s) = %v, %v, want %v", vector, got, err, want)
+		}
+	}
+
+	for _, vector := range []string{
+		"CVSS:4.0/AV:N/AC:L/AT:N/PR:N/UI:N/VC:H/VI:H/VA:H/SC:N/SI:N/SA:N",
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H",
+		"CVSS:3.1/AV:X/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H",
+	} {
+		if _, err := cvssV3BaseScore(vector); err == nil {
+			t.Errorf("expected %s to be rejected", vector)
+		}
+	}
+}
+
+// an OSV record whose only severity is the CVSS v3 vector, shaped like the
+// published record of curl's SOCKS5 heap overflow
+const testOSVVectorOnly = `[
+  {
+    "id": "CVE-2023-38545",
+    "modified": "2024-09-18T03:24:42Z",
+    "published": "2023-10-18T04:15:11Z",
+    "severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+    "affected": [{
+      "package": {"ecosystem": "Debian:12", "name": "curl"},
+      "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "7.88.1-10+deb12u4"}]}]
+    }]
+  }
+]`
+
+func TestVulnerabilitySeverityFromVector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+	if err := os.WriteFile(path, []byte(testOSVVectorOnly), 0644); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := loadVulnerabilityFeed(path)
+	if err != nil {
+		t.Fatalf("Failed to load feed: %v", err)
+	}
+
+	packages := []PackageInfo{{Name: "curl", Version: "7.88.1-10+deb12u3", NewVersion: "7.88.1-10+deb12u4", Arch: "amd64"}}
+	packages = annotateVulnerabilities(feed, "Debian:12", map[string]string{"curl": "curl"}, nil, packages)
+	if len(packages) != 1 || packages[0].Severity != SeverityCritical {
+		t.Fatalf("Expected curl with a critical CVE, got %+v", packages)
+	}
+	if selected := criticalUpgrades(packages); len(selected) != 1 || selected[0] != "curl" {
+		t.Errorf("Expected curl to be selected, got %v", selected)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -16,24 +17,99 @@ func main() {
 		}
 	} else {
 		switch os.Args[1] {
-		case "sysup":
-			autoYes := false
-			if len(os.Args) > 2 && os.Args[2] == "-y" {
-				autoYes = true
+		case "show":
+			flags := flag.NewFlagSet("show", flag.ExitOnError)
+			details := flags.Bool("details", false, "also show changelogs and advisories of pending updates")
+			flags.Parse(os.Args[2:])
+			err := agent.RunShowMetrics()
+			if err == nil && *details {
+				err = agent.RunShowDetails()
 			}
-			err := agent.RunSysup(autoYes)
+			if err != nil {
+				fmt.Println("Error running one-shot mode:", err)
+				os.Exit(1)
+			}
+		case "sysup":
+			flags := flag.NewFlagSet("sysup", flag.ExitOnError)
+			autoYes := flags.Bool("y", false, "upgrade without asking for confirmation")
+			dryRun := flags.Bool("dry-run", false, "show what the upgrade would change without changing the system")
+			flags.Parse(os.Args[2:])
+			err := agent.RunSysup(*autoYes, *dryRun)
 			if err != nil {
 				fmt.Println("Error performing system upgrade:", err)
 				os.Exit(1)
 			}
+		case "enroll":
+			flags := flag.NewFlagSet("enroll", flag.ExitOnError)
+			enrollmentKey := flags.String("enrollment-key", "", "enrollment key issued by the backend")
+			force := flags.Bool("force", false, "enroll again even if this host already has a credential")
+			flags.Parse(os.Args[2:])
+			err := agent.RunEnroll(*enrollmentKey, *force)
+			if err != nil {
+				fmt.Println("Error enrolling agent:", err)
+				os.Exit(1)
+			}
+		case "rollback":
+			flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+			autoYes := flags.Bool("y", false, "roll back without asking for confirmation")
+			flags.Parse(os.Args[2:])
+			if flags.NArg() != 1 {
+				fmt.Println("Usage: ./redt-agent rollback [-y] UPGRADE_ID")
+				os.Exit(1)
+			}
+			err := agent.RunRollback(flags.Arg(0), *autoYes)
+			if err != nil {
+				fmt.Println("Error rolling back upgrade:", err)
+				os.Exit(1)
+			}
+		case "history":
+			flags := flag.NewFlagSet("history", flag.ExitOnError)
+			since := flags.String("since", "", "only runs started since a date, RFC 3339 time or age like 7d")
+			asJSON := flags.Bool("json", false, "print JSON")
+			flags.Parse(os.Args[2:])
+			err := agent.RunHistory(*since, *asJSON, flags.Arg(0))
+			if err != nil {
+				fmt.Println("Error reading upgrade history:", err)
+				os.Exit(1)
+			}
+		case "pkg":
+			if len(os.Args) < 3 || (os.Args[2] != "install" && os.Args[2] != "remove") {
+				fmt.Println("Usage: ./redt-agent pkg install|remove [-y] NAME...")
+				os.Exit(1)
+			}
+			flags := flag.NewFlagSet("pkg "+os.Args[2], flag.ExitOnError)
+			autoYes := flags.Bool("y", false, "change packages without asking for confirmation")
+			flags.Parse(os.Args[3:])
+			if flags.NArg() == 0 {
+				fmt.Println("Usage: ./redt-agent pkg install|remove [-y] NAME...")
+				os.Exit(1)
+			}
+			err := agent.RunPackageChange(os.Args[2], flags.Args(), *autoYes)
+			if err != nil {
+				fmt.Printf("Error running package %s: %v\n", os.Args[2], err)
+				os.Exit(1)
+			}
+		case "helper":
+			err := agent.RunHelper()
+			if err != nil {
+				fmt.Println("Error running helper:", err)
+				os.Exit(1)
+			}
 		case "-d":
 			agent.RunDaemon()
 		default:
 			fmt.Println("Invalid argument. Usage:")
 			fmt.Println("./redt-agent                (show system metrics)")
+			fmt.Println("./redt-agent show --details  (show system metrics and the changelogs and advisories of pending updates)")
 			fmt.Println("./redt-agent sysup          (system upgrade)")
 			fmt.Println("./redt-agent sysup -y       (system upgrade with automatic confirmation)")
+			fmt.Println("./redt-agent sysup --dry-run  (show what a system upgrade would change)")
+			fmt.Println("./redt-agent enroll --enrollment-key KEY  (register this host with the backend)")
+			fmt.Println("./redt-agent rollback UPGRADE_ID  (revert the packages changed by an upgrade)")
+			fmt.Println("./redt-agent history [--since 7d] [--json] [UPGRADE_ID]  (list or inspect past upgrades)")
+			fmt.Println("./redt-agent pkg install|remove [-y] NAME...  (install or remove packages)")
 			fmt.Println("./redt-agent -d             (daemon mode)")
+			fmt.Println("./redt-agent helper         (root helper performing upgrades for an unprivileged daemon)")
 			os.Exit(1)
 		}
 	}
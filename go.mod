@@ -15,6 +15,8 @@ require (
 
 require github.com/bluet/syspkg v0.1.6 // direct
 
+require github.com/klauspost/compress v1.18.0 // direct
+
 require (
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"time"
 )
 
@@ -8,3 +10,10 @@ import (
 func CurrentTimestamp() string {
 	return time.Now().Format("2006-01-02 15:04:05")
 }
+
+// RandomID returns a random 128-bit identifier encoded as hex.
+func RandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
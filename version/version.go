@@ -0,0 +1,296 @@
+// Package version compares package versions the way dpkg and rpm do, and
+// classifies upgrades as major, minor or patch updates.
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Format is a package version syntax
+type Format int
+
+const (
+	// Deb versions are [epoch:]upstream[-revision], compared like dpkg --compare-versions
+	Deb Format = iota
+	// RPM versions are [epoch:]version[-release], compared like rpmvercmp
+	RPM
+)
+
+// Update types, from the most to the least disruptive
+const (
+	Major = "major"
+	Minor = "minor"
+	Patch = "patch"
+)
+
+// Compare returns -1, 0 or 1 if a is older than, the same as or newer than b
+func Compare(format Format, a, b string) int {
+	if format == RPM {
+		return CompareRPM(a, b)
+	}
+	return CompareDeb(a, b)
+}
+
+// CompareDeb compares two Debian package versions
+func CompareDeb(a, b string) int {
+	va, vb := parse(a), parse(b)
+	if va.epoch != vb.epoch {
+		return sign(va.epoch - vb.epoch)
+	}
+	if c := verrevcmp(va.version, vb.version); c != 0 {
+		return c
+	}
+	return verrevcmp(va.release, vb.release)
+}
+
+// CompareRPM compares two RPM versions, given as EVR or as a bare version. As
+// in dnf, a release is only compared if both versions have one.
+func CompareRPM(a, b string) int {
+	va, vb := parse(a), parse(b)
+	if va.epoch != vb.epoch {
+		return sign(va.epoch - vb.epoch)
+	}
+	if c := rpmvercmp(va.version, vb.version); c != 0 {
+		return c
+	}
+	if va.release == "" || vb.release == "" {
+		return 0
+	}
+	return rpmvercmp(va.release, vb.release)
+}
+
+// UpdateType classifies the update from old to new by the first differing
+// component of the upstream version: an epoch change or a change of the first
+// component is a major update, of the second a minor one, and anything later,
+// including a change of only the Debian revision or RPM release, is a patch.
+// It returns "" if new is not newer than old.
+func UpdateType(format Format, old, new string) string {
+	if Compare(format, old, new) >= 0 {
+		return ""
+	}
+	vo, vn := parse(old), parse(new)
+	if vo.epoch != vn.epoch {
+		return Major
+	}
+	co, cn := components(vo.version), components(vn.version)
+	for i := 0; i < 2; i++ {
+		if component(co, i) != component(cn, i) {
+			if i == 0 {
+				return Major
+			}
+			return Minor
+		}
+	}
+	return Patch
+}
+
+type parsed struct {
+	epoch   int
+	version string // upstream version
+	release string // Debian revision or RPM release
+}
+
+func parse(v string) parsed {
+	var p parsed
+	if before, after, ok := strings.Cut(v, ":"); ok {
+		if epoch, err := strconv.Atoi(before); err == nil {
+			p.epoch = epoch
+			v = after
+		}
+	}
+	// the upstream version may itself contain hyphens; the revision may not
+	if i := strings.LastIndex(v, "-"); i >= 0 {
+		p.version, p.release = v[:i], v[i+1:]
+	} else {
+		p.version = v
+	}
+	return p
+}
+
+// components splits an upstream version like 15.99.1+dfsg1 into 15, 99, 1, dfsg1
+func components(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return !isDigit(byte(r)) && !isAlpha(byte(r))
+	})
+}
+
+func component(c []string, i int) string {
+	if i >= len(c) {
+		return ""
+	}
+	return strings.TrimLeft(c[i], "0")
+}
+
+// order is dpkg's character weight: "~" sorts before everything, even the end
+// of the string, and letters sort before other characters
+func order(c byte) int {
+	switch {
+	case isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
+	}
+}
+
+// verrevcmp is dpkg's comparison of an upstream version or revision
+func verrevcmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		firstDiff := 0
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			ac, bc := 0, 0
+			if i < len(a) {
+				ac = order(a[i])
+			}
+			if j < len(b) {
+				bc = order(b[j])
+			}
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			i++
+			j++
+		}
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		for i < len(a) && isDigit(a[i]) && j < len(b) && isDigit(b[j]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+		}
+		if i < len(a) && isDigit(a[i]) {
+			return 1
+		}
+		if j < len(b) && isDigit(b[j]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return sign(firstDiff)
+		}
+	}
+	return 0
+}
+
+// rpmvercmp is rpm's comparison of a version or release: alternating numeric
+// and alphabetic segments, with "~" sorting before and "^" after the end
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	isSep := func(c byte) bool {
+		return !isDigit(c) && !isAlpha(c) && c != '~' && c != '^'
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		for len(a) > 0 && isSep(a[0]) {
+			a = a[1:]
+		}
+		for len(b) > 0 && isSep(b[0]) {
+			b = b[1:]
+		}
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if a == "" {
+				return -1
+			}
+			if b == "" {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		match := isAlpha
+		if numeric {
+			match = isDigit
+		}
+		segA, segB := span(a, match), span(b, match)
+		a, b = a[len(segA):], b[len(segB):]
+
+		// a numeric segment is newer than an alphabetic one
+		if segB == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA, segB = strings.TrimLeft(segA, "0"), strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return sign(len(segA) - len(segB))
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	if a == "" && b == "" {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	return 1
+}
+
+// span returns the longest prefix of s whose bytes all match
+func span(s string, match func(byte) bool) string {
+	i := 0
+	for i < len(s) && match(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package version
+
+import "testing"
+
+func TestCompareDeb(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.001", "1.1", 0},
+		{"1:0.9", "2.0", 1},
+		{"1:15.99.1+dfsg1-1ubuntu2", "1:15.99.1+dfsg1-1ubuntu2.1", -1},
+		{"1:15.99.1+dfsg1-1ubuntu2", "15.99.1+dfsg1-1ubuntu3", 1},
+		{"7.81.0-1ubuntu1.16", "7.81.0-1ubuntu1.15", 1},
+		{"3.0.11-1~deb12u1", "3.0.11-1~deb12u2", -1},
+		{"3.0.11-1~deb12u2", "3.0.11-1", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc1~1", 1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0+dfsg", "1.0.1", -1},
+		{"2.36-9+deb12u4", "2.36-9+deb12u10", -1},
+		{"5.15.0-91.101", "5.15.0-101.111", -1},
+		{"1.2.3-4-5", "1.2.3-4-6", -1},
+		{"2:8.2.3995-1ubuntu2.15", "2:8.2.3995-1ubuntu2.9", 1},
+		{"1.1.1f-1ubuntu2.20", "1.1.1f-1ubuntu2.3", 1},
+		{"4.4.7-1", "4.4.7a-1", -1},
+	}
+	for _, test := range tests {
+		if got := CompareDeb(test.a, test.b); got != test.want {
+			t.Errorf("CompareDeb(%q, %q) = %d, expected %d", test.a, test.b, got, test.want)
+		}
+		if got := CompareDeb(test.b, test.a); got != -test.want {
+			t.Errorf("CompareDeb(%q, %q) = %d, expected %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestCompareRPM(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		// from rpm's own rpmvercmp tests
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0.1", "2.0.1a", -1},
+		{"5.5p1", "5.5p2", -1},
+		{"5.5p10", "5.5p1", 1},
+		{"10xyz", "10.1xyz", -1},
+		{"xyz10", "xyz10.1", -1},
+		{"1.0aa", "1.0a", 1},
+		{"10.0001", "10.1", 0},
+		{"10.0001", "10.0039", -1},
+		{"4.999.9", "5.0", -1},
+		{"20101121", "20101122", -1},
+		{"2_0", "2_0", 0},
+		{"2.0", "2_0", 0},
+		{"a", "a", 0},
+		{"a+", "a_", 0},
+		{"+", "_", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc1~git123", "1.0~rc1", -1},
+		{"1.0^", "1.0", 1},
+		{"1.0^git1", "1.0", 1},
+		{"1.0^git1", "1.01", -1},
+		{"1.0^20160101", "1.0.1", -1},
+		{"1.0^git1~pre", "1.0^git1", -1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0", 1},
+		// EVR
+		{"1:1.0-1", "2.0-1", 1},
+		{"0:2.34-60.el9", "2.34-100.el9", -1},
+		{"7.76.1-26.el9_3.2", "7.76.1-26.el9_3.3", -1},
+		{"3.0.7-27.el9", "3.0.7", 0},
+		{"1:3.0.7-24.el9", "1:3.0.7-27.el9", -1},
+		{"5.14.0-362.8.1.el9_3", "5.14.0-362.13.1.el9_3", -1},
+		{"2.9.13-5.el9", "2.9.13-5.el9_2", -1},
+	}
+	for _, test := range tests {
+		if got := CompareRPM(test.a, test.b); got != test.want {
+			t.Errorf("CompareRPM(%q, %q) = %d, expected %d", test.a, test.b, got, test.want)
+		}
+		if got := CompareRPM(test.b, test.a); got != -test.want {
+			t.Errorf("CompareRPM(%q, %q) = %d, expected %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestUpdateType(t *testing.T) {
+	tests := []struct {
+		format   Format
+		old, new string
+		want     string
+	}{
+		{Deb, "1:15.99.1+dfsg1-1ubuntu2", "1:15.99.1+dfsg1-1ubuntu2.1", Patch},
+		{Deb, "3.0.11-1~deb12u1", "3.0.11-1~deb12u2", Patch},
+		{Deb, "7.81.0-1ubuntu1.15", "7.81.0-1ubuntu1.16", Patch},
+		{Deb, "1.2.3-1", "1.2.4-1", Patch},
+		{Deb, "1.2.3-1", "1.3.0-1", Minor},
+		{Deb, "1.2-1", "1.2.1-1", Patch},
+		{Deb, "2.9-1", "3.0-1", Major},
+		{Deb, "1:9.0-1", "2:1.0-1", Major},
+		{Deb, "5.15.0-91.101", "5.15.0-101.111", Patch},
+		{Deb, "1.2.4-1", "1.2.3-1", ""},
+		{Deb, "1.2.3-1", "1.2.3-1", ""},
+		{RPM, "7.76.1-26.el9_3.2", "7.76.1-26.el9_3.3", Patch},
+		{RPM, "3.0.7-27.el9", "3.2.1-1.el9", Minor},
+		{RPM, "0:2.34-60.el9", "1:2.34-60.el9", Major},
+		{RPM, "115.5.0-1.el9", "128.1.0-1.el9", Major},
+	}
+	for _, test := range tests {
+		if got := UpdateType(test.format, test.old, test.new); got != test.want {
+			t.Errorf("UpdateType(%q, %q) = %q, expected %q", test.old, test.new, got, test.want)
+		}
+	}
+}